@@ -0,0 +1,107 @@
+// +build !windows
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// uucpLock is a UUCP-style lock file. It holds the PID of its owner as
+// ten ASCII digits and a newline, and is named LCK.. followed by the
+// base name of the device.
+type uucpLock struct {
+	path string
+}
+
+// lockUUCP creates the lock file for the device name in dir, removing a
+// stale one. It returns a *PortBusyError if another process holds the
+// lock.
+func lockUUCP(dir, name string) (*uucpLock, error) {
+	// Symlinks like /dev/serial/by-id/... must lock the real device.
+	dev := name
+	if real, err := filepath.EvalSymlinks(name); err == nil {
+		dev = real
+	}
+	l := &uucpLock{path: filepath.Join(dir, "LCK.."+filepath.Base(dev))}
+
+	// Write to a temporary file and link it into place, so that other
+	// processes never see a lock file without a PID.
+	tmp, err := ioutil.TempFile(dir, "LTMP.")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = fmt.Fprintf(tmp, "%10d\n", os.Getpid())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(tmp.Name(), 0644)
+
+	err = os.Link(tmp.Name(), l.path)
+	if err == nil {
+		return l, nil
+	}
+	if !os.IsExist(err) {
+		return nil, err
+	}
+	// A lock file we can't read may be written in a format we don't
+	// know, so it is only taken over if its owner is gone.
+	pid := readLockPID(l.path)
+	if pid <= 0 || processExists(pid) {
+		return nil, &PortBusyError{Name: name, PID: pid}
+	}
+	// Replace the stale lock in one step. Removing it first would let
+	// another process that found it stale too remove our new lock.
+	// Reading the PID back catches one that renamed its own lock over
+	// ours in the meantime.
+	if err := os.Rename(tmp.Name(), l.path); err != nil {
+		return nil, err
+	}
+	if pid := readLockPID(l.path); pid != os.Getpid() {
+		return nil, &PortBusyError{Name: name, PID: pid}
+	}
+	return l, nil
+}
+
+// unlock removes the lock file.
+func (l *uucpLock) unlock() error {
+	return os.Remove(l.path)
+}
+
+// readLockPID returns the PID in a lock file, or 0 if there is none.
+func readLockPID(path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// processExists reports whether a process with the given PID exists.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// busyError reports the error returned when opening a device that
+// another process opened with TIOCEXCL as a *PortBusyError.
+func busyError(name string, err error) error {
+	if errors.Is(err, syscall.EBUSY) {
+		return &PortBusyError{Name: name, PID: deviceHolder(name)}
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+// +build !windows
+
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockUUCP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serial-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "LCK..ttyS9")
+
+	l, err := lockUUCP(dir, "/dev/ttyS9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if want := fmt.Sprintf("%10d\n", os.Getpid()); err != nil || string(b) != want {
+		t.Errorf("lock file holds %q, %v, want %q", b, err, want)
+	}
+
+	_, err = lockUUCP(dir, "/dev/ttyS9")
+	var busy *PortBusyError
+	if !errors.As(err, &busy) || busy.PID != os.Getpid() || !errors.Is(err, ErrPortBusy) {
+		t.Errorf("second lock returned %v, want busy with PID %d", err, os.Getpid())
+	}
+
+	if err := l.unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock file still exists after unlock: %v", err)
+	}
+}
+
+func TestLockUUCPStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "serial-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "LCK..ttyS9")
+
+	// No process has a PID this large.
+	if err := ioutil.WriteFile(path, []byte("2147483646\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := lockUUCP(dir, "/dev/ttyS9")
+	if err != nil {
+		t.Fatalf("lock over stale file: %v", err)
+	}
+	if pid := readLockPID(path); pid != os.Getpid() {
+		t.Errorf("lock file holds PID %d, want %d", pid, os.Getpid())
+	}
+	l.unlock()
+
+	// A lock file that can't be read is left alone.
+	if err := ioutil.WriteFile(path, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockUUCP(dir, "/dev/ttyS9"); !errors.Is(err, ErrPortBusy) {
+		t.Errorf("lock over unreadable file returned %v, want ErrPortBusy", err)
+	}
+	if b, _ := ioutil.ReadFile(path); string(b) != "garbage" {
+		t.Errorf("unreadable lock file replaced with %q", b)
+	}
+}
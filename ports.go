@@ -0,0 +1,140 @@
+package serial
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// PortInfo describes a serial port found by ListPorts.
+type PortInfo struct {
+	Name   string // device path, such as /dev/ttyUSB0
+	Driver string // kernel driver, such as ftdi_sio or cdc_acm
+
+	// The remaining fields are only set for USB devices.
+	USB          bool
+	VID, PID     uint16 // vendor and product IDs
+	SerialNumber string
+	Manufacturer string
+	Product      string
+	Interface    int    // interface number within the device
+	Location     string // USB bus path of the interface, such as 1-1.2:1.0
+}
+
+// byIDDir holds the stable names udev gives serial ports.
+const byIDDir = "/dev/serial/by-id"
+
+// PortMatch selects a port by its identity in Config.Match. A port
+// matches if all the fields that are set match.
+type PortMatch struct {
+	SerialNumber string
+	VID, PID     uint16
+	Location     string // as in PortInfo
+	ByID         string // name or path in /dev/serial/by-id
+}
+
+func (m *PortMatch) String() string {
+	var s []string
+	if m.SerialNumber != "" {
+		s = append(s, "serial "+m.SerialNumber)
+	}
+	switch {
+	case m.VID != 0 && m.PID != 0:
+		s = append(s, fmt.Sprintf("%04x:%04x", m.VID, m.PID))
+	case m.VID != 0:
+		s = append(s, fmt.Sprintf("vid %04x", m.VID))
+	case m.PID != 0:
+		s = append(s, fmt.Sprintf("pid %04x", m.PID))
+	}
+	if m.Location != "" {
+		s = append(s, "location "+m.Location)
+	}
+	if m.ByID != "" {
+		s = append(s, m.ByID)
+	}
+	return strings.Join(s, " ")
+}
+
+// ErrEmptyMatch is returned by OpenPort if Config.Match has no field
+// set, which would match any port.
+var ErrEmptyMatch = errors.New("serial port match has no fields set")
+
+// MatchError is returned by OpenPort if no port, or more than one port,
+// matches Config.Match.
+type MatchError struct {
+	Match      PortMatch
+	Candidates []PortInfo // the ports that matched, or all ports if none did
+	Matched    int        // number of ports that matched
+}
+
+func (e *MatchError) Error() string {
+	var s strings.Builder
+	if e.Matched == 0 {
+		fmt.Fprintf(&s, "no serial port matches %v", &e.Match)
+	} else {
+		fmt.Fprintf(&s, "%d serial ports match %v", e.Matched, &e.Match)
+	}
+	if len(e.Candidates) == 0 {
+		return s.String()
+	}
+	s.WriteString("; candidates:")
+	for i, p := range e.Candidates {
+		if i > 0 {
+			s.WriteString(",")
+		}
+		fmt.Fprintf(&s, " %s", p.Name)
+		if p.USB {
+			fmt.Fprintf(&s, " (%04x:%04x", p.VID, p.PID)
+			if p.SerialNumber != "" {
+				fmt.Fprintf(&s, " serial %s", p.SerialNumber)
+			}
+			fmt.Fprintf(&s, " location %s)", p.Location)
+		}
+	}
+	return s.String()
+}
+
+// findPort returns the name of the one port that matches m.
+func findPort(m *PortMatch) (string, error) {
+	ports, err := ListPorts()
+	if err != nil {
+		return "", err
+	}
+	return matchPort(m, ports, byIDDir)
+}
+
+// matchPort returns the name of the one port in ports that matches m,
+// resolving by-id names in byID.
+func matchPort(m *PortMatch, ports []PortInfo, byID string) (string, error) {
+	if *m == (PortMatch{}) {
+		return "", ErrEmptyMatch
+	}
+	var dev string
+	if m.ByID != "" {
+		path := m.ByID
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(byID, path)
+		}
+		dev, _ = filepath.EvalSymlinks(path)
+	}
+	var matched []PortInfo
+	for _, p := range ports {
+		if m.SerialNumber != "" && p.SerialNumber != m.SerialNumber ||
+			m.VID != 0 && p.VID != m.VID ||
+			m.PID != 0 && p.PID != m.PID ||
+			m.Location != "" && p.Location != m.Location ||
+			m.ByID != "" && p.Name != dev {
+			continue
+		}
+		matched = append(matched, p)
+	}
+	if len(matched) == 1 {
+		return matched[0].Name, nil
+	}
+	err := &MatchError{Match: *m, Candidates: matched, Matched: len(matched)}
+	if len(matched) == 0 {
+		err.Candidates = ports
+	}
+	return "", err
+}
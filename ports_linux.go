@@ -0,0 +1,105 @@
+// +build linux
+
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ListPorts returns the serial ports present on the system, sorted by
+// name. It finds them in sysfs, so it doesn't open any of them.
+func ListPorts() ([]PortInfo, error) {
+	return listPorts("/sys")
+}
+
+// listPorts lists the serial ports in the sysfs tree at root.
+func listPorts(root string) ([]PortInfo, error) {
+	class := filepath.Join(root, "class", "tty")
+	entries, err := ioutil.ReadDir(class)
+	if err != nil {
+		return nil, err
+	}
+	var ports []PortInfo
+	for _, e := range entries {
+		info, ok := portInfo(filepath.Join(class, e.Name()))
+		if ok {
+			ports = append(ports, info)
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return ports, nil
+}
+
+// portInfo describes the tty at the sysfs path tty. It reports false
+// for virtual terminals, ptys and other ttys without a serial device.
+func portInfo(tty string) (PortInfo, bool) {
+	dev, err := filepath.EvalSymlinks(filepath.Join(tty, "device"))
+	if err != nil {
+		return PortInfo{}, false
+	}
+	// The 8250 driver registers ports that may not exist; their type
+	// is PORT_UNKNOWN.
+	if t, err := readAttr(tty, "type"); err == nil && t == "0" {
+		return PortInfo{}, false
+	}
+	info := PortInfo{
+		Name:   "/dev/" + filepath.Base(tty),
+		Driver: driver(dev),
+	}
+
+	// usb-serial ports have a device of their own below the USB
+	// interface, cdc_acm ports use the interface itself.
+	intf := dev
+	for !exists(filepath.Join(intf, "bInterfaceNumber")) {
+		intf = filepath.Dir(intf)
+		if filepath.Base(intf) == "devices" || intf == filepath.Dir(intf) {
+			return info, true // not a USB device
+		}
+	}
+	if info.Driver == "" {
+		info.Driver = driver(intf)
+	}
+	usb := filepath.Dir(intf)
+	info.USB = true
+	info.VID = uint16(readHexAttr(usb, "idVendor"))
+	info.PID = uint16(readHexAttr(usb, "idProduct"))
+	info.SerialNumber, _ = readAttr(usb, "serial")
+	info.Manufacturer, _ = readAttr(usb, "manufacturer")
+	info.Product, _ = readAttr(usb, "product")
+	info.Interface = int(readHexAttr(intf, "bInterfaceNumber"))
+	info.Location = filepath.Base(intf)
+	return info, true
+}
+
+// driver returns the name of the driver bound to the sysfs device dev.
+func driver(dev string) string {
+	d, err := os.Readlink(filepath.Join(dev, "driver"))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(d)
+}
+
+// readAttr returns the sysfs attribute name of dir, without the
+// trailing newline.
+func readAttr(dir, name string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(b)), err
+}
+
+// readHexAttr returns the value of a hexadecimal sysfs attribute, or 0.
+func readHexAttr(dir, name string) uint64 {
+	s, _ := readAttr(dir, name)
+	n, _ := strconv.ParseUint(s, 16, 16)
+	return n
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
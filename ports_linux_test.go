@@ -0,0 +1,101 @@
+// +build linux
+
+package serial
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeSysfs builds a sysfs tree in dir from a list of files, with
+// their contents, and symlinks, whose contents start with "->".
+func fakeSysfs(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		if len(content) > 2 && content[:2] == "->" {
+			err = os.Symlink(content[2:], path)
+		} else {
+			err = ioutil.WriteFile(path, []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestListPorts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const ftdi = "devices/pci0000:00/0000:00:14.0/usb1/1-2"
+	const acm = "devices/pci0000:00/0000:00:14.0/usb1/1-3"
+	const pnp = "devices/pnp0/00:03"
+	fakeSysfs(t, dir, map[string]string{
+		// An FTDI adapter, with a usb-serial port below the interface.
+		ftdi + "/idVendor":                           "0403\n",
+		ftdi + "/idProduct":                          "6001\n",
+		ftdi + "/serial":                             "A600XYZ\n",
+		ftdi + "/manufacturer":                       "FTDI\n",
+		ftdi + "/product":                            "FT232R USB UART\n",
+		ftdi + "/1-2:1.0/bInterfaceNumber":           "00\n",
+		ftdi + "/1-2:1.0/driver":                     "->../../../../../../bus/usb/drivers/ftdi_sio",
+		ftdi + "/1-2:1.0/ttyUSB0/driver":             "->../../../../../../../bus/usb-serial/drivers/ftdi_sio",
+		ftdi + "/1-2:1.0/ttyUSB0/tty/ttyUSB0/dev":    "188:0\n",
+		"class/tty/ttyUSB0":                          "->../../" + ftdi + "/1-2:1.0/ttyUSB0/tty/ttyUSB0",
+		ftdi + "/1-2:1.0/ttyUSB0/tty/ttyUSB0/device": "->../../../ttyUSB0",
+
+		// A CDC ACM device on its second interface.
+		acm + "/idVendor":                   "2341\n",
+		acm + "/idProduct":                  "0043\n",
+		acm + "/1-3:1.2/bInterfaceNumber":   "02\n",
+		acm + "/1-3:1.2/driver":             "->../../../../../../bus/usb/drivers/cdc_acm",
+		acm + "/1-3:1.2/tty/ttyACM0/dev":    "166:0\n",
+		acm + "/1-3:1.2/tty/ttyACM0/device": "->../../../1-3:1.2",
+		"class/tty/ttyACM0":                 "->../../" + acm + "/1-3:1.2/tty/ttyACM0",
+
+		// A real and a missing 8250 port.
+		pnp + "/driver":                                "->../../../bus/pnp/drivers/serial",
+		pnp + "/tty/ttyS0/type":                        "4\n",
+		pnp + "/tty/ttyS0/device":                      "->../../../00:03",
+		"class/tty/ttyS0":                              "->../../" + pnp + "/tty/ttyS0",
+		"devices/platform/serial8250/driver":           "->../../../bus/platform/drivers/serial8250",
+		"devices/platform/serial8250/tty/ttyS1/type":   "0\n",
+		"devices/platform/serial8250/tty/ttyS1/device": "->../../../serial8250",
+		"class/tty/ttyS1":                              "->../../devices/platform/serial8250/tty/ttyS1",
+
+		// A virtual terminal.
+		"devices/virtual/tty/tty0/dev": "4:0\n",
+		"class/tty/tty0":               "->../../devices/virtual/tty/tty0",
+	})
+
+	got, err := listPorts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PortInfo{
+		{
+			Name: "/dev/ttyACM0", Driver: "cdc_acm",
+			USB: true, VID: 0x2341, PID: 0x0043, Interface: 2, Location: "1-3:1.2",
+		},
+		{Name: "/dev/ttyS0", Driver: "serial"},
+		{
+			Name: "/dev/ttyUSB0", Driver: "ftdi_sio",
+			USB: true, VID: 0x0403, PID: 0x6001,
+			SerialNumber: "A600XYZ", Manufacturer: "FTDI", Product: "FT232R USB UART",
+			Location: "1-2:1.0",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listPorts returned\n%+v\nwant\n%+v", got, want)
+	}
+}
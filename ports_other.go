@@ -0,0 +1,9 @@
+// +build !linux
+
+package serial
+
+// ListPorts returns the serial ports present on the system. It is only
+// implemented on Linux, and returns ErrNotSupported elsewhere.
+func ListPorts() ([]PortInfo, error) {
+	return nil, ErrNotSupported
+}
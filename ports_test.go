@@ -0,0 +1,79 @@
+package serial
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "by-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dev := filepath.Join(dir, "ttyUSB1")
+	if err := ioutil.WriteFile(dev, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The temporary directory may be behind a symlink itself.
+	if dev, err = filepath.EvalSymlinks(dev); err != nil {
+		t.Fatal(err)
+	}
+	const byID = "usb-FTDI_FT232R_USB_UART_B700-if00-port0"
+	if err := os.Symlink(dev, filepath.Join(dir, byID)); err != nil {
+		t.Skip("no symlinks:", err)
+	}
+
+	ports := []PortInfo{
+		{Name: "/dev/ttyS0"},
+		{Name: "/dev/ttyUSB0", USB: true, VID: 0x0403, PID: 0x6001, SerialNumber: "A600", Location: "1-2:1.0"},
+		{Name: dev, USB: true, VID: 0x0403, PID: 0x6001, SerialNumber: "B700", Location: "1-3:1.0"},
+		{Name: "/dev/ttyACM0", USB: true, VID: 0x2341, PID: 0x0043, Location: "1-4:1.0"},
+	}
+	tests := []struct {
+		m       PortMatch
+		want    string
+		matched int // ports matched if there is an error
+	}{
+		{PortMatch{SerialNumber: "A600"}, "/dev/ttyUSB0", 0},
+		{PortMatch{VID: 0x2341, PID: 0x0043}, "/dev/ttyACM0", 0},
+		{PortMatch{Location: "1-3:1.0"}, dev, 0},
+		{PortMatch{ByID: byID}, dev, 0},
+		{PortMatch{ByID: filepath.Join(dir, byID)}, dev, 0},
+		{PortMatch{VID: 0x0403, SerialNumber: "B700"}, dev, 0},
+		{PortMatch{VID: 0x0403}, "", 2},
+		{PortMatch{SerialNumber: "C800"}, "", 0},
+		{PortMatch{ByID: "usb-missing"}, "", 0},
+	}
+	for _, tt := range tests {
+		got, err := matchPort(&tt.m, ports, dir)
+		if tt.want != "" {
+			if got != tt.want || err != nil {
+				t.Errorf("%v: matched %q, %v, want %q", &tt.m, got, err, tt.want)
+			}
+			continue
+		}
+		var merr *MatchError
+		if !errors.As(err, &merr) {
+			t.Errorf("%v: matched %q, %v, want a *MatchError", &tt.m, got, err)
+			continue
+		}
+		if merr.Matched != tt.matched {
+			t.Errorf("%v: %d ports matched, want %d", &tt.m, merr.Matched, tt.matched)
+		}
+		candidates := len(ports)
+		if tt.matched > 0 {
+			candidates = tt.matched
+		}
+		if len(merr.Candidates) != candidates {
+			t.Errorf("%v: %d candidates, want %d", &tt.m, len(merr.Candidates), candidates)
+		}
+	}
+
+	if got, err := matchPort(&PortMatch{}, ports, dir); err != ErrEmptyMatch {
+		t.Errorf("empty match: matched %q, %v, want ErrEmptyMatch", got, err)
+	}
+}
@@ -0,0 +1,304 @@
+package serial
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ConnState is the connection state of a ResilientPort.
+type ConnState int
+
+const (
+	StateConnected    ConnState = iota + 1 // the port is open
+	StateDisconnected                      // the device went away
+	StateReconnecting                      // an attempt to reopen it failed
+	StateClosed                            // Close was called
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Default values for ResilientConfig.
+const (
+	DefaultMinBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff = 5 * time.Second
+)
+
+// ResilientConfig configures how a ResilientPort reconnects.
+type ResilientConfig struct {
+	// The delay between attempts to reopen the port starts at
+	// MinBackoff and doubles up to MaxBackoff. On Linux, an attempt is
+	// also made whenever a serial port is added. If 0,
+	// DefaultMinBackoff and DefaultMaxBackoff are used.
+	MinBackoff, MaxBackoff time.Duration
+
+	// OnStateChange, if set, is called with each change of state, and
+	// the error that caused it, if any. It is called from the goroutine
+	// that noticed the change, and must not block for long.
+	OnStateChange func(state ConnState, err error)
+}
+
+// ResilientPort is a port that is reopened after its device goes away,
+// for example when a USB adapter is unplugged and plugged back in. It
+// looks for the same adapter, by its serial number or the USB port it
+// was plugged into, unless Config.Match says otherwise. The ports of a
+// multi-port adapter share its serial number and are told apart by
+// their USB interface.
+//
+// Reads and Writes in progress when the device goes away return
+// ErrDisconnected, as data may have been lost. Later ones wait until the
+// port is reopened, or closed. A positive ReadTimeout or WriteTimeout
+// also limits the wait, after which they return ErrTimeout.
+type ResilientPort struct {
+	c  *Config
+	rc ResilientConfig
+
+	mu     sync.Mutex
+	cond   *sync.Cond // signalled when port or closed change
+	port   *Port      // nil while disconnected
+	closed bool
+	done   chan struct{} // closed by Close
+}
+
+// OpenResilientPort opens the port described by c like OpenPort, and
+// keeps reopening it as configured by rc, which may be nil.
+func OpenResilientPort(c *Config, rc *ResilientConfig) (*ResilientPort, error) {
+	p, err := OpenPort(c)
+	if err != nil {
+		return nil, err
+	}
+	r := &ResilientPort{port: p, done: make(chan struct{})}
+	r.cond = sync.NewCond(&r.mu)
+	if rc != nil {
+		r.rc = *rc
+	}
+	if r.rc.MinBackoff <= 0 {
+		r.rc.MinBackoff = DefaultMinBackoff
+	}
+	if r.rc.MaxBackoff <= 0 {
+		r.rc.MaxBackoff = DefaultMaxBackoff
+	}
+	if r.rc.MaxBackoff < r.rc.MinBackoff {
+		r.rc.MaxBackoff = r.rc.MinBackoff
+	}
+
+	// Reopen the port by the identity of its device, which keeps it
+	// through a change of name.
+	cc := *c
+	if cc.Match == nil {
+		cc.Match = identify(c.Name)
+	}
+	r.c = &cc
+	return r, nil
+}
+
+// identify returns a match for the USB adapter of the port name, or
+// nil if it isn't one.
+func identify(name string) *PortMatch {
+	if dev, err := filepath.EvalSymlinks(name); err == nil {
+		name = dev
+	}
+	ports, _ := ListPorts()
+	return identifyPort(name, ports)
+}
+
+// identifyPort returns a match for the port name that selects it alone
+// among ports, or nil if there is none. The serial number is preferred,
+// as it follows the adapter to another USB port, but multi-port
+// adapters share it between their ports, which only the location tells
+// apart.
+func identifyPort(name string, ports []PortInfo) *PortMatch {
+	for _, p := range ports {
+		if p.Name != name || !p.USB {
+			continue
+		}
+		var matches []*PortMatch
+		if p.SerialNumber != "" {
+			matches = append(matches, &PortMatch{VID: p.VID, PID: p.PID, SerialNumber: p.SerialNumber})
+		}
+		if p.Location != "" {
+			matches = append(matches, &PortMatch{VID: p.VID, PID: p.PID, Location: p.Location})
+		}
+		for _, m := range matches {
+			if found, err := matchPort(m, ports, byIDDir); err == nil && found == name {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// Read reads from the port, waiting for it to be reopened if it is
+// disconnected.
+func (r *ResilientPort) Read(b []byte) (int, error) {
+	p, err := r.get(r.c.ReadTimeout)
+	if err != nil {
+		return 0, err
+	}
+	n, err := p.Read(b)
+	return n, r.check(p, err)
+}
+
+// Write writes to the port, waiting for it to be reopened if it is
+// disconnected.
+func (r *ResilientPort) Write(b []byte) (int, error) {
+	p, err := r.get(r.c.WriteTimeout)
+	if err != nil {
+		return 0, err
+	}
+	n, err := p.Write(b)
+	return n, r.check(p, err)
+}
+
+// Port returns the port currently open, or nil while disconnected. It
+// can be used for the methods ResilientPort doesn't have, but should not
+// be closed.
+func (r *ResilientPort) Port() *Port {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.port
+}
+
+// Close closes the port and stops reopening it. Reads and Writes
+// waiting for the port return ErrClosed.
+func (r *ResilientPort) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	r.closed = true
+	p := r.port
+	r.port = nil
+	close(r.done)
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	r.notify(StateClosed, nil)
+	if p == nil {
+		return nil
+	}
+	return p.Close()
+}
+
+// get returns the open port, waiting for it while disconnected. If
+// timeout is positive, it gives up after that long with ErrTimeout.
+func (r *ResilientPort) get(timeout time.Duration) (*Port, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	expired := false
+	if r.port == nil && !r.closed && timeout > 0 {
+		t := time.AfterFunc(timeout, func() {
+			r.mu.Lock()
+			expired = true
+			r.cond.Broadcast()
+			r.mu.Unlock()
+		})
+		defer t.Stop()
+	}
+	for r.port == nil && !r.closed && !expired {
+		r.cond.Wait()
+	}
+	switch {
+	case r.closed:
+		return nil, ErrClosed
+	case r.port == nil:
+		return nil, ErrTimeout
+	}
+	return r.port, nil
+}
+
+// check starts reopening p if err says its device went away, and
+// returns the error to report for it.
+func (r *ResilientPort) check(p *Port, err error) error {
+	if err != ErrDisconnected && err != ErrClosed {
+		return err
+	}
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return ErrClosed
+	}
+	// A Read and a Write may both notice; only the first reconnects.
+	lost := r.port == p
+	if lost {
+		r.port = nil
+	}
+	r.mu.Unlock()
+
+	if lost {
+		p.Close()
+		r.notify(StateDisconnected, ErrDisconnected)
+		go r.reconnect()
+	}
+	return ErrDisconnected
+}
+
+// reconnect reopens the port, backing off between attempts, until it
+// succeeds or the ResilientPort is closed.
+func (r *ResilientPort) reconnect() {
+	// Added ports are worth trying at once. Without Watch, the backoff
+	// alone has to do.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	added, _ := Watch(ctx)
+
+	backoff := r.rc.MinBackoff
+	for {
+		timer := time.NewTimer(backoff)
+		select {
+		case <-r.done:
+			timer.Stop()
+			return
+		case ev, ok := <-added:
+			timer.Stop()
+			if !ok {
+				added = nil
+				continue
+			}
+			if ev.Op != PortAdded {
+				continue
+			}
+		case <-timer.C:
+			if backoff *= 2; backoff > r.rc.MaxBackoff {
+				backoff = r.rc.MaxBackoff
+			}
+		}
+
+		p, err := OpenPort(r.c)
+		if err != nil {
+			r.notify(StateReconnecting, err)
+			continue
+		}
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			p.Close()
+			return
+		}
+		r.port = p
+		r.cond.Broadcast()
+		r.mu.Unlock()
+		r.notify(StateConnected, nil)
+		return
+	}
+}
+
+func (r *ResilientPort) notify(state ConnState, err error) {
+	if r.rc.OnStateChange != nil {
+		r.rc.OnStateChange(state, err)
+	}
+}
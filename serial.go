@@ -10,16 +10,16 @@ manually:
 
  GOOS=windows make clean install
 
-Currently there is very little in the way of configurability.  You can
-set the baud rate.  Then you can Read(), Write(), or Close() the
-connection.  Read() will block until at least one byte is returned.
-Write is the same.  There is currently no exposed way to set the
-timeouts, though patches are welcome.
+A port is opened with a Config, which sets the baud rate, the data
+bits, parity and stop bits, RTS/CTS and XON/XOFF flow control, and the
+read and write timeouts.  Then you can Read(), Write(), or Close() the
+connection.  By default Read() will block until at least one byte is
+returned, and Write until all bytes are written.  SetConfig changes
+the settings of an open port.
 
-Currently all ports are opened with 8 data bits, 1 stop bit, no
-parity, no hardware flow control, and no software flow control.  This
-works fine for many real devices and many faux serial devices
-including usb-to-serial converters and bluetooth serial ports.
+The defaults are 8 data bits, 1 stop bit, no parity and no flow
+control.  This works fine for many real devices and many faux serial
+devices including usb-to-serial converters and bluetooth serial ports.
 
 You may Read() and Write() simulantiously on the same connection (from
 different goroutines).
@@ -56,12 +56,22 @@ Example usage:
 package serial
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"time"
 )
 
 const DefaultSize = 8 // Default value for Config.Size
 
+const (
+	DefaultXONChar  = 0x11 // Default value for Config.XONChar (DC1)
+	DefaultXOFFChar = 0x13 // Default value for Config.XOFFChar (DC3)
+)
+
+const DefaultLockDir = "/var/lock" // Default value for Config.LockDir
+
 type StopBits byte
 type Parity byte
 
@@ -99,6 +109,16 @@ type Config struct {
 	Baud        int
 	ReadTimeout time.Duration // Total timeout
 
+	// InterCharTimeout, if positive, makes Read keep waiting after the
+	// first byte until the line has been quiet for this long or the
+	// buffer is full. ReadTimeout still limits the Read as a whole.
+	InterCharTimeout time.Duration
+
+	// WriteTimeout, if positive, limits how long a Write may take. A
+	// Write that times out returns the number of bytes the driver
+	// accepted and ErrTimeout.
+	WriteTimeout time.Duration
+
 	// Size is the number of data bits. If 0, DefaultSize is used.
 	Size byte
 
@@ -108,13 +128,95 @@ type Config struct {
 	// Number of stop bits to use. Default is 1 (1 stop bit).
 	StopBits StopBits
 
-	// RTSFlowControl bool
+	// RTSFlowControl enables RTS/CTS hardware flow control.
+	RTSFlowControl bool
+
+	// XONFlowControl enables XON/XOFF software flow control in both
+	// directions.
+	XONFlowControl bool
+
+	// XONAny allows any received character, not just XONChar, to
+	// restart output stopped by XOFF. Not supported on Windows, where
+	// it makes OpenPort fail with ErrBadFlowControl.
+	XONAny bool
+
+	// XONChar and XOFFChar are the start and stop characters used for
+	// software flow control. If 0, DC1 (0x11) and DC3 (0x13) are used.
+	XONChar  byte
+	XOFFChar byte
+
+	// RS485 enables RS-485 half-duplex operation if set.
+	RS485 *RS485Config
+
+	// ReportErrors makes Read return a *LineError at the point in the
+	// stream where a break, or a byte with a framing or parity error,
+	// was received. Otherwise such bytes are passed through or dropped
+	// by the driver.
+	ReportErrors bool
+
+	// Exclusive keeps other processes from opening the port while it
+	// is open, with TIOCEXCL and an flock on the device. Ports are
+	// always opened exclusively on Windows.
+	Exclusive bool
+
+	// Lock creates a UUCP-style lock file, LCK..<device>, in LockDir
+	// while the port is open, as minicom and other serial programs
+	// do. Lock files left behind by processes that no longer exist are
+	// replaced. Not supported on Windows, where OpenPort returns
+	// ErrNotSupported.
+	Lock bool
+
+	// LockDir is the directory for lock files. If empty,
+	// DefaultLockDir is used.
+	LockDir string
+
+	// HangupOnClose lowers DTR and RTS when the port is closed (HUPCL).
+	// Leave it unset for boards, like Arduinos, that reset when DTR
+	// drops. Ignored on Windows, where the driver decides.
+	HangupOnClose bool
+
+	// RestoreOnClose restores the settings the port had before it was
+	// opened when it is closed, except that HangupOnClose still
+	// applies. On Linux and other Unix systems, output still queued is
+	// given a limited time to be transmitted with the current settings
+	// first.
+	RestoreOnClose bool
+
+	// Match, if set, selects the port to open by its identity, such as
+	// the serial number of a USB adapter, and Name is ignored. OpenPort
+	// returns a *MatchError unless exactly one port matches. Only
+	// supported on Linux.
+	Match *PortMatch
+
 	// DTRFlowControl bool
-	// XONFlowControl bool
 
 	// CRLFTranslate bool
 }
 
+// RS485Config contains the settings for RS-485 half-duplex operation,
+// where the RTS line enables the line driver while transmitting.
+//
+// If the driver does not support RS-485, RTS is instead switched around
+// each Write by this package, which waits for the data to be sent
+// before releasing the line. This is less precise, and RxDuringTx is
+// not supported then. On Windows the driver's RTS toggle mode is used,
+// which raises RTS while sending and ignores the other settings.
+type RS485Config struct {
+	// RTSOnSend and RTSAfterSend are the levels of RTS while sending
+	// and after sending (true meaning high).
+	RTSOnSend    bool
+	RTSAfterSend bool
+
+	// DelayBeforeSend and DelayAfterSend are how long RTS is set
+	// before the first byte is sent and kept after the last one. The
+	// driver has a resolution of one millisecond.
+	DelayBeforeSend time.Duration
+	DelayAfterSend  time.Duration
+
+	// RxDuringTx keeps the receiver enabled while sending.
+	RxDuringTx bool
+}
+
 // ErrBadSize is returned if Size is not supported.
 var ErrBadSize error = errors.New("unsupported serial data size")
 
@@ -124,44 +226,468 @@ var ErrBadStopBits error = errors.New("unsupported stop bit setting")
 // ErrBadParity is returned if the parity is not supported.
 var ErrBadParity error = errors.New("unsupported parity setting")
 
+// ErrBadFlowControl is returned if the requested flow control cannot be
+// enabled on the port.
+var ErrBadFlowControl error = errors.New("unsupported flow control setting")
+
+// ErrClosed is returned by operations on a port that has been closed,
+// including Reads and Writes that were blocked when Close was called.
+var ErrClosed error = errors.New("serial port closed")
+
+// ErrTimeout is returned by Read when ReadTimeout passes before any
+// byte arrives, and by Write when WriteTimeout passes before all bytes
+// are written. Like net.Error, it has a Timeout method that reports
+// true.
+var ErrTimeout error = timeoutError{}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "serial port timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// ErrDisconnected is returned by Read and Write once the device has
+// gone away, for example when a USB adapter is unplugged or the tty
+// hangs up. The port should be closed.
+var ErrDisconnected error = errors.New("serial port disconnected")
+
+// ErrNotSupported is returned if the driver of an open port does not
+// support the requested operation, for example modem control lines on
+// a pseudo-terminal.
+var ErrNotSupported error = errors.New("operation not supported by serial port")
+
+// ErrPortBusy is returned, wrapped in a *PortBusyError, by OpenPort if
+// the port is in use by another process. Check for it with errors.Is.
+var ErrPortBusy error = errors.New("serial port busy")
+
+// PortBusyError is returned by OpenPort if the port is in use by
+// another process.
+type PortBusyError struct {
+	Name string // name of the port
+	PID  int    // process holding the port, or 0 if unknown
+}
+
+func (e *PortBusyError) Error() string {
+	if e.PID != 0 {
+		return fmt.Sprintf("serial port %s busy: held by process %d", e.Name, e.PID)
+	}
+	return fmt.Sprintf("serial port %s busy", e.Name)
+}
+
+// Is reports whether target is ErrPortBusy.
+func (e *PortBusyError) Is(target error) bool {
+	return target == ErrPortBusy
+}
+
+// LineError is returned by Read when Config.ReportErrors is set and a
+// break or a corrupted byte was received. The bytes received before it
+// are returned by earlier calls to Read, and those received after it
+// by later ones.
+type LineError struct {
+	Break bool // a break condition was received
+	Char  byte // the byte received with a framing or parity error
+}
+
+func (e *LineError) Error() string {
+	if e.Break {
+		return "serial: break received"
+	}
+	return fmt.Sprintf("serial: framing or parity error on byte %#02x", e.Char)
+}
+
+// ModemStatus is the state of the modem status lines of a port.
+type ModemStatus struct {
+	CTS bool // Clear To Send
+	DSR bool // Data Set Ready
+	DCD bool // Data Carrier Detect
+	RI  bool // Ring Indicator
+}
+
+// ModemEvent describes a change of the modem status lines.
+type ModemEvent struct {
+	Time    time.Time   // when the change was observed
+	Status  ModemStatus // state of the lines after the change
+	Changed ModemStatus // lines that changed state
+}
+
+// diff reports which lines differ between s and o.
+func (s ModemStatus) diff(o ModemStatus) ModemStatus {
+	return ModemStatus{
+		CTS: s.CTS != o.CTS,
+		DSR: s.DSR != o.DSR,
+		DCD: s.DCD != o.DCD,
+		RI:  s.RI != o.RI,
+	}
+}
+
 // OpenPort opens a serial port with the specified configuration
 func OpenPort(c *Config) (*Port, error) {
-	size, par, stop := c.Size, c.Parity, c.StopBits
-	if size == 0 {
-		size = DefaultSize
+	c = c.withDefaults()
+	if c.Match != nil {
+		name, err := findPort(c.Match)
+		if err != nil {
+			return nil, err
+		}
+		c.Name = name
+	}
+	return openPort(c)
+}
+
+// withDefaults returns a copy of c with unset fields replaced by their
+// default values.
+func (c *Config) withDefaults() *Config {
+	d := *c
+	if d.Size == 0 {
+		d.Size = DefaultSize
 	}
-	if par == 0 {
-		par = ParityNone
+	if d.Parity == 0 {
+		d.Parity = ParityNone
 	}
-	if stop == 0 {
-		stop = Stop1
+	if d.StopBits == 0 {
+		d.StopBits = Stop1
 	}
-	return openPort(c.Name, c.Baud, size, par, stop, c.ReadTimeout)
+	if d.XONChar == 0 {
+		d.XONChar = DefaultXONChar
+	}
+	if d.XOFFChar == 0 {
+		d.XOFFChar = DefaultXOFFChar
+	}
+	if d.LockDir == "" {
+		d.LockDir = DefaultLockDir
+	}
+	return &d
+}
+
+// SetBaud changes the baud rate of the open port.
+func (p *Port) SetBaud(baud int) error {
+	c := *p.c
+	c.Baud = baud
+	return p.SetConfig(&c)
+}
+
+// SetReadTimeout changes the read timeout of the open port.
+func (p *Port) SetReadTimeout(d time.Duration) error {
+	c := *p.c
+	c.ReadTimeout = d
+	return p.SetConfig(&c)
 }
 
-// Converts the timeout values for Linux / POSIX systems
-func posixTimeoutValues(readTimeout time.Duration) (vmin uint8, vtime uint8) {
-	const MAXUINT8 = 1<<8 - 1 // 255
-	// set blocking / non-blocking read
-	var minBytesToRead uint8 = 1
-	var readTimeoutInDeci int64
-	if readTimeout > 0 {
-		// EOF on zero read
-		minBytesToRead = 0
-		// convert timeout to deciseconds as expected by VTIME
-		readTimeoutInDeci = (readTimeout.Nanoseconds() / 1e6 / 100)
-		// capping the timeout
-		if readTimeoutInDeci < 1 {
-			// min possible timeout 1 Deciseconds (0.1s)
-			readTimeoutInDeci = 1
-		} else if readTimeoutInDeci > MAXUINT8 {
-			// max possible timeout is 255 deciseconds (25.5s)
-			readTimeoutInDeci = MAXUINT8
+// ModemEvents returns a channel that receives an event every time one
+// of the CTS, DSR, DCD or RI lines changes. Changes made while an event
+// waits to be received are reported with the next one. The channel is
+// closed when ctx is done or waiting fails, for example because the
+// port was closed. It returns ErrNotSupported if the platform cannot
+// wait for modem changes. See WaitModemChange for how changes are
+// noticed.
+func (p *Port) ModemEvents(ctx context.Context) (<-chan ModemEvent, error) {
+	w, err := p.newModemWatcher()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan ModemEvent)
+	go func() {
+		defer close(ch)
+		for {
+			ev, err := w.wait(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
+	return ch, nil
+}
+
+// WaitModemChange blocks until one of the CTS, DSR, DCD or RI lines
+// changes, or the port is closed.
+//
+// On Linux the lines are polled every 10ms rather than waited on with
+// TIOCMIWAIT, which neither Close nor a context could interrupt. Events
+// may therefore arrive up to 10ms late; pulses shorter than that are
+// still reported if the driver counts modem interrupts, as most UART
+// drivers do. On Windows the driver signals the changes, and elsewhere
+// WaitModemChange returns ErrNotSupported.
+func (p *Port) WaitModemChange() (ModemEvent, error) {
+	w, err := p.newModemWatcher()
+	if err != nil {
+		return ModemEvent{}, err
 	}
-	return minBytesToRead, uint8(readTimeoutInDeci)
+	return w.wait(context.Background())
 }
 
-// func SendBreak()
+// aLongTimeAgo is a deadline in the past, used to interrupt I/O.
+var aLongTimeAgo = time.Unix(1, 0)
 
-// func RegisterBreakHandler(func())
+// ReadContext is like Read, but gives up and returns ctx.Err() when ctx
+// is done. It replaces the read deadline of the port with that of ctx
+// for the duration of the call, and clears it afterwards.
+func (p *Port) ReadContext(ctx context.Context, b []byte) (int, error) {
+	return withContext(ctx, p.SetReadDeadline, p.Read, b)
+}
+
+// WriteContext is like Write, but gives up and returns ctx.Err() when
+// ctx is done, along with the number of bytes written so far. It
+// replaces the write deadline of the port with that of ctx for the
+// duration of the call, and clears it afterwards.
+func (p *Port) WriteContext(ctx context.Context, b []byte) (int, error) {
+	return withContext(ctx, p.SetWriteDeadline, p.Write, b)
+}
+
+// withContext calls rw(b), using setDeadline to stop it when ctx is
+// done.
+func withContext(ctx context.Context, setDeadline func(time.Time) error, rw func([]byte) (int, error), b []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	deadline, _ := ctx.Deadline()
+	if err := setDeadline(deadline); err != nil {
+		return 0, err
+	}
+	defer setDeadline(time.Time{})
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			setDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	n, err := rw(b)
+	close(stop)
+	<-stopped
+
+	if err != nil && ctx.Err() != nil {
+		return n, ctx.Err()
+	}
+	return n, err
+}
+
+// ReadFrame reads one frame into b, for protocols such as Modbus RTU
+// that delimit frames by silence on the line. It waits for the first
+// byte like Read, then reads until no byte arrives for gap character
+// times or b is full. ReadFrame must not be called concurrently with
+// Read.
+func (p *Port) ReadFrame(b []byte, gap float64) (int, error) {
+	return p.readFrame(b, time.Duration(gap*float64(p.c.charTime())))
+}
+
+// charTime returns the time it takes to send one character with the
+// configured baud rate and framing.
+func (c *Config) charTime() time.Duration {
+	if c.Baud <= 0 {
+		return 0
+	}
+	halfBits := 2 * (1 + int(c.Size)) // start and data bits
+	if c.Parity != ParityNone {
+		halfBits += 2
+	}
+	switch c.StopBits {
+	case Stop1Half:
+		halfBits += 3
+	case Stop2:
+		halfBits += 4
+	default:
+		halfBits += 2
+	}
+	return time.Duration(halfBits) * time.Second / time.Duration(2*c.Baud)
+}
+
+// WriteAddressed writes addr with mark parity, followed by data with
+// space parity, as used for 9-bit addressing on multidrop buses. The
+// port is left set to space parity, and the number of bytes of data
+// written is returned.
+func (p *Port) WriteAddressed(addr byte, data []byte) (int, error) {
+	c := *p.c
+	c.Parity = ParityMark
+	if err := p.SetConfig(&c); err != nil {
+		return 0, err
+	}
+	if _, err := p.Write([]byte{addr}); err != nil {
+		return 0, err
+	}
+	// SetConfig waits for the address to be sent before switching.
+	c.Parity = ParitySpace
+	if err := p.SetConfig(&c); err != nil {
+		return 0, err
+	}
+	return p.Write(data)
+}
+
+// Drain waits until all output written to the port has been
+// transmitted, up to the last stop bit if the driver can tell. Use it
+// before turning a half-duplex line around. If ctx is done first, Drain
+// returns its error and the output stays queued.
+func (p *Port) Drain(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.drain(ctx)
+}
+
+// drain waits until all output written to the port has been
+// transmitted. The output queue is polled rather than waited on with
+// tcdrain, which neither ctx nor Close could interrupt.
+func (p *Port) drain(ctx context.Context) error {
+	// Without new output, waitSent only waits for the UART.
+	release, err := p.holdOutput(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := p.waitOutput(ctx); err != nil {
+		return err
+	}
+	return p.waitSent()
+}
+
+// waitOutput waits until the driver's output queue is empty, or ctx is
+// done.
+func (p *Port) waitOutput(ctx context.Context) error {
+	for {
+		n, err := p.OutputWaiting()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		// Look again about when the queue should be empty, but often
+		// enough to notice ctx being done.
+		wait := time.Duration(n) * p.c.charTime()
+		if wait < time.Millisecond {
+			wait = time.Millisecond
+		} else if wait > 50*time.Millisecond {
+			wait = 50 * time.Millisecond
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// SendBreak transmits a break condition for duration d, after any
+// output already written has been transmitted.
+func (p *Port) SendBreak(d time.Duration) error {
+	if err := p.drain(context.Background()); err != nil {
+		return err
+	}
+	if err := p.SetBreak(); err != nil {
+		return err
+	}
+	time.Sleep(d)
+	return p.ClearBreak()
+}
+
+// RegisterBreakHandler sets f to be called by Read whenever a break is
+// received, in addition to returning a *LineError. Breaks are only
+// detected with Config.ReportErrors set. RegisterBreakHandler must not be
+// called concurrently with Read.
+func (p *Port) RegisterBreakHandler(f func()) {
+	p.breakHandler = f
+}
+
+// onBreak calls the registered break handler, if any.
+func (p *Port) onBreak() {
+	if p.breakHandler != nil {
+		p.breakHandler()
+	}
+}
+
+// lineErrorReader decodes the marks the terminal driver inserts into
+// the input with PARMRK set: \377 \377 is a literal \377, \377 \0 \0 a
+// break and \377 \0 c a byte c received with a framing or parity error.
+type lineErrorReader struct {
+	r       io.Reader
+	onBreak func()
+	raw     []byte // read buffer
+	buf     []byte // raw input not decoded yet, within raw
+	err     error  // error from r, returned once buf is drained
+}
+
+func (d *lineErrorReader) Read(b []byte) (int, error) {
+	for {
+		n, lerr, used := d.decode(b)
+		d.buf = d.buf[used:]
+		if n > 0 {
+			return n, nil
+		}
+		if lerr != nil {
+			if lerr.Break && d.onBreak != nil {
+				d.onBreak()
+			}
+			return 0, lerr
+		}
+		if d.err != nil {
+			err := d.err
+			d.err = nil
+			return 0, err
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+
+		// Only an incomplete mark, or nothing at all, is left.
+		need := len(d.buf) + len(b) + 2
+		if cap(d.raw) < need {
+			d.raw = make([]byte, need)
+		}
+		k := copy(d.raw[:need], d.buf)
+		m, err := d.r.Read(d.raw[k:need])
+		d.buf = d.raw[:k+m]
+		d.err = err
+		if m == 0 && err == nil {
+			return 0, nil
+		}
+	}
+}
+
+// decode copies the input in d.buf into b up to the first line error.
+// It returns the number of bytes written to b, the line error if one is
+// next in the input and nothing was written, and the number of bytes
+// of d.buf that were consumed.
+func (d *lineErrorReader) decode(b []byte) (n int, lerr *LineError, used int) {
+	buf := d.buf
+	for used < len(buf) && n < len(b) {
+		if buf[used] != 0377 {
+			b[n] = buf[used]
+			n++
+			used++
+			continue
+		}
+		if used+1 >= len(buf) {
+			break // incomplete mark
+		}
+		if buf[used+1] != 0 {
+			// \377 \377, or a lone \377 we don't understand.
+			b[n] = 0377
+			n++
+			if buf[used+1] == 0377 {
+				used += 2
+			} else {
+				used++
+			}
+			continue
+		}
+		if used+2 >= len(buf) {
+			break // incomplete mark
+		}
+		if n > 0 {
+			break // return the data first
+		}
+		lerr = &LineError{Break: buf[used+2] == 0, Char: buf[used+2]}
+		return 0, lerr, used + 3
+	}
+	return n, nil, used
+}
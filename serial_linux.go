@@ -3,68 +3,130 @@
 package serial
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
 )
 
-func openPort(name string, baud int, databits byte, parity Parity, stopbits StopBits, readTimeout time.Duration) (p *Port, err error) {
-	var bauds = map[int]uint32{
-		50:      unix.B50,
-		75:      unix.B75,
-		110:     unix.B110,
-		134:     unix.B134,
-		150:     unix.B150,
-		200:     unix.B200,
-		300:     unix.B300,
-		600:     unix.B600,
-		1200:    unix.B1200,
-		1800:    unix.B1800,
-		2400:    unix.B2400,
-		4800:    unix.B4800,
-		9600:    unix.B9600,
-		19200:   unix.B19200,
-		38400:   unix.B38400,
-		57600:   unix.B57600,
-		115200:  unix.B115200,
-		230400:  unix.B230400,
-		460800:  unix.B460800,
-		500000:  unix.B500000,
-		576000:  unix.B576000,
-		921600:  unix.B921600,
-		1000000: unix.B1000000,
-		1152000: unix.B1152000,
-		1500000: unix.B1500000,
-		2000000: unix.B2000000,
-		2500000: unix.B2500000,
-		3000000: unix.B3000000,
-		3500000: unix.B3500000,
-		4000000: unix.B4000000,
-	}
-
-	rate, ok := bauds[baud]
-
-	if !ok {
-		return nil, fmt.Errorf("Unrecognized baud rate")
-	}
+var bauds = map[int]uint32{
+	50:      unix.B50,
+	75:      unix.B75,
+	110:     unix.B110,
+	134:     unix.B134,
+	150:     unix.B150,
+	200:     unix.B200,
+	300:     unix.B300,
+	600:     unix.B600,
+	1200:    unix.B1200,
+	1800:    unix.B1800,
+	2400:    unix.B2400,
+	4800:    unix.B4800,
+	9600:    unix.B9600,
+	19200:   unix.B19200,
+	38400:   unix.B38400,
+	57600:   unix.B57600,
+	115200:  unix.B115200,
+	230400:  unix.B230400,
+	460800:  unix.B460800,
+	500000:  unix.B500000,
+	576000:  unix.B576000,
+	921600:  unix.B921600,
+	1000000: unix.B1000000,
+	1152000: unix.B1152000,
+	1500000: unix.B1500000,
+	2000000: unix.B2000000,
+	2500000: unix.B2500000,
+	3000000: unix.B3000000,
+	3500000: unix.B3500000,
+	4000000: unix.B4000000,
+}
 
-	f, err := os.OpenFile(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0666)
+func openPort(c *Config) (p *Port, err error) {
+	t, err := makeTermios(c)
 	if err != nil {
 		return nil, err
 	}
 
+	var lock *uucpLock
+	if c.Lock {
+		if lock, err = lockUUCP(c.LockDir, c.Name); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				lock.unlock()
+			}
+		}()
+	}
+
+	f, err := os.OpenFile(c.Name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0666)
+	if err != nil {
+		return nil, busyError(c.Name, err)
+	}
+
 	defer func() {
 		if err != nil && f != nil {
 			f.Close()
 		}
 	}()
 
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	p = &Port{f: f, rc: rc, c: c, lock: lock, sending: make(chan struct{}, 1)}
+	if c.Exclusive {
+		if err = p.setExclusive(); err != nil {
+			return nil, err
+		}
+	}
+	err = p.control(func(fd uintptr) (err error) {
+		if p.orig, err = getTermios(fd); err != nil {
+			return err
+		}
+		p.baud, err = setTermios(fd, t)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	p.setReportErrors(c.ReportErrors)
+	if c.RS485 != nil {
+		if err = p.setRS485(c.RS485); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// makeTermios builds the terminal settings described by c.
+func makeTermios(c *Config) (*unix.Termios, error) {
 	// Base settings
-	cflagToUse := unix.CREAD | unix.CLOCAL | rate
-	switch databits {
+	cflagToUse := uint32(unix.CREAD | unix.CLOCAL)
+	if c.HangupOnClose {
+		cflagToUse |= unix.HUPCL
+	}
+	var speed uint32
+	if rate, ok := bauds[c.Baud]; ok {
+		cflagToUse |= rate
+		speed = rate
+	} else if c.Baud > 0 {
+		// Not one of the predefined rates, so ask the driver for the
+		// exact value through termios2.
+		cflagToUse |= unix.BOTHER
+		speed = uint32(c.Baud)
+	} else {
+		return nil, fmt.Errorf("Unrecognized baud rate")
+	}
+	switch c.Size {
 	case 5:
 		cflagToUse |= unix.CS5
 	case 6:
@@ -77,7 +139,7 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 		return nil, ErrBadSize
 	}
 	// Stop bits settings
-	switch stopbits {
+	switch c.StopBits {
 	case Stop1:
 		// default is 1 stop bit
 	case Stop2:
@@ -87,7 +149,7 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 		return nil, ErrBadStopBits
 	}
 	// Parity settings
-	switch parity {
+	switch c.Parity {
 	case ParityNone:
 		// default is no parity
 	case ParityOdd:
@@ -95,70 +157,618 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 		cflagToUse |= unix.PARODD
 	case ParityEven:
 		cflagToUse |= unix.PARENB
+	case ParityMark:
+		cflagToUse |= unix.PARENB | unix.CMSPAR | unix.PARODD
+	case ParitySpace:
+		cflagToUse |= unix.PARENB | unix.CMSPAR
 	default:
 		return nil, ErrBadParity
 	}
-	fd := f.Fd()
-	vmin, vtime := posixTimeoutValues(readTimeout)
-	t := unix.Termios{
-		Iflag:  unix.IGNPAR,
+	// Flow control settings
+	if c.RTSFlowControl {
+		if c.RS485 != nil {
+			// RTS can't be used for both.
+			return nil, ErrBadFlowControl
+		}
+		cflagToUse |= unix.CRTSCTS
+	}
+	if c.XONFlowControl && c.XONChar == c.XOFFChar {
+		return nil, ErrBadFlowControl
+	}
+	iflagToUse := uint32(unix.IGNPAR)
+	if c.ReportErrors {
+		// Mark breaks and bad bytes in the input for lineErrorReader.
+		iflagToUse = unix.INPCK | unix.PARMRK
+	}
+	if c.XONFlowControl {
+		iflagToUse |= unix.IXON | unix.IXOFF
+		if c.XONAny {
+			iflagToUse |= unix.IXANY
+		}
+	}
+	t := &unix.Termios{
+		Iflag:  iflagToUse,
 		Cflag:  cflagToUse,
-		Ispeed: rate,
-		Ospeed: rate,
+		Ispeed: speed,
+		Ospeed: speed,
 	}
-	t.Cc[unix.VMIN] = vmin
-	t.Cc[unix.VTIME] = vtime
+	// Return from read as soon as there is data. With the descriptor in
+	// non-blocking mode, an empty read then fails with EAGAIN and waits
+	// in the poller, and ReadTimeout is applied as a deadline.
+	t.Cc[unix.VMIN] = 1
+	t.Cc[unix.VTIME] = 0
+	t.Cc[unix.VSTART] = c.XONChar
+	t.Cc[unix.VSTOP] = c.XOFFChar
+	return t, nil
+}
 
-	if _, _, errno := unix.Syscall6(
-		unix.SYS_IOCTL,
-		uintptr(fd),
-		uintptr(unix.TCSETS),
-		uintptr(unsafe.Pointer(&t)),
-		0,
-		0,
-		0,
-	); errno != 0 {
-		return nil, errno
+// setTermios applies t to fd and returns the baud rate the driver
+// actually selected. If the driver doesn't accept all of t, the
+// previous settings are put back.
+func setTermios(fd uintptr, t *unix.Termios) (int, error) {
+	prev, err := getTermios(fd)
+	if err != nil {
+		return 0, err
+	}
+	req := uint(unix.TCSETS)
+	if t.Cflag&unix.CBAUD == unix.BOTHER {
+		req = tcsets2
+	}
+	if err := ioctl(fd, req, uintptr(unsafe.Pointer(t))); err != nil {
+		return 0, err
 	}
 
-	if err = unix.SetNonblock(int(fd), false); err != nil {
-		return
+	// The driver silently drops flags it does not support, so read the
+	// settings back to make sure parity and flow control were accepted.
+	got, err := getTermios(fd)
+	if err != nil {
+		return 0, err
+	}
+	const parity = unix.PARENB | unix.CMSPAR | unix.PARODD
+	switch {
+	case got.Cflag&parity != t.Cflag&parity:
+		err = ErrBadParity
+	case got.Cflag&unix.CRTSCTS != t.Cflag&unix.CRTSCTS ||
+		got.Iflag&(unix.IXON|unix.IXOFF) != t.Iflag&(unix.IXON|unix.IXOFF):
+		err = ErrBadFlowControl
+	default:
+		return termiosBaud(got), nil
 	}
+	ioctl(fd, tcsets2, uintptr(unsafe.Pointer(prev)))
+	return 0, err
+}
 
-	return &Port{f: f}, nil
+// getTermios reads the current terminal settings of fd.
+func getTermios(fd uintptr) (*unix.Termios, error) {
+	t := new(unix.Termios)
+	if err := ioctl(fd, tcgets2, uintptr(unsafe.Pointer(t))); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// termiosBaud returns the output baud rate selected by t.
+func termiosBaud(t *unix.Termios) int {
+	rate := t.Cflag & unix.CBAUD
+	if rate == unix.BOTHER {
+		return int(t.Ospeed)
+	}
+	for baud, r := range bauds {
+		if r == rate {
+			return baud
+		}
+	}
+	return 0
+}
+
+// configFromTermios decodes the settings in t into a Config.
+func configFromTermios(t *unix.Termios) *Config {
+	c := &Config{
+		Baud:     termiosBaud(t),
+		Parity:   ParityNone,
+		StopBits: Stop1,
+		XONChar:  t.Cc[unix.VSTART],
+		XOFFChar: t.Cc[unix.VSTOP],
+	}
+	switch t.Cflag & unix.CSIZE {
+	case unix.CS5:
+		c.Size = 5
+	case unix.CS6:
+		c.Size = 6
+	case unix.CS7:
+		c.Size = 7
+	case unix.CS8:
+		c.Size = 8
+	}
+	switch t.Cflag & (unix.PARENB | unix.CMSPAR | unix.PARODD) {
+	case unix.PARENB | unix.PARODD:
+		c.Parity = ParityOdd
+	case unix.PARENB:
+		c.Parity = ParityEven
+	case unix.PARENB | unix.CMSPAR | unix.PARODD:
+		c.Parity = ParityMark
+	case unix.PARENB | unix.CMSPAR:
+		c.Parity = ParitySpace
+	}
+	if t.Cflag&unix.CSTOPB != 0 {
+		c.StopBits = Stop2
+	}
+	c.RTSFlowControl = t.Cflag&unix.CRTSCTS != 0
+	c.XONFlowControl = t.Iflag&(unix.IXON|unix.IXOFF) != 0
+	c.XONAny = t.Iflag&unix.IXANY != 0
+	c.HangupOnClose = t.Cflag&unix.HUPCL != 0
+	return c
 }
 
 type Port struct {
 	// We intentionly do not use an "embedded" struct so that we
 	// don't export File
-	f *os.File
+	f    *os.File
+	rc   syscall.RawConn
+	dl   deadlines
+	c    *Config
+	baud int
+
+	lr           *lineErrorReader // set if c.ReportErrors
+	breakHandler func()
+	rs485        *RS485Config // set if Write has to switch RTS itself
+
+	orig    *unix.Termios // settings before openPort
+	lock    *uucpLock     // set if c.Lock
+	sending chan struct{} // see holdOutput
+	closed  int32         // set by Close; accessed atomically
 }
 
 func (p *Port) Read(b []byte) (n int, err error) {
-	return p.f.Read(b)
+	if p.lr != nil {
+		return p.lr.Read(b)
+	}
+	return p.readFile(b)
 }
 
 func (p *Port) Write(b []byte) (n int, err error) {
-	return p.f.Write(b)
+	if p.rs485 != nil {
+		return p.writeRS485(p.rs485, b)
+	}
+	return p.writeFile(b)
+}
+
+// Baud returns the baud rate selected by the driver, which may differ
+// slightly from the requested rate for non-standard values.
+func (p *Port) Baud() int {
+	return p.baud
+}
+
+// SetConfig changes the settings of the open port to those in c. Output
+// already written is transmitted with the old settings first. c.Name
+// is ignored.
+func (p *Port) SetConfig(c *Config) error {
+	c = c.withDefaults()
+	c.Name = p.c.Name
+	t, err := makeTermios(c)
+	if err != nil {
+		return err
+	}
+	if err := p.drain(context.Background()); err != nil {
+		return err
+	}
+	var baud int
+	err = p.control(func(fd uintptr) (err error) {
+		baud, err = setTermios(fd, t)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if c.RS485 != nil || p.c.RS485 != nil {
+		if err := p.setRS485(c.RS485); err != nil {
+			return err
+		}
+	}
+	p.c, p.baud = c, baud
+	p.setReportErrors(c.ReportErrors)
+	return nil
+}
+
+// setRS485 enables RS-485 mode with the settings in rc, or disables it
+// if rc is nil. If the driver has no RS-485 support, RTS is set by
+// Write instead.
+func (p *Port) setRS485(rc *RS485Config) error {
+	var rs serialRS485
+	if rc != nil {
+		rs.flags = serRS485Enabled
+		if rc.RTSOnSend {
+			rs.flags |= serRS485RTSOnSend
+		}
+		if rc.RTSAfterSend {
+			rs.flags |= serRS485RTSAfterSend
+		}
+		if rc.RxDuringTx {
+			rs.flags |= serRS485RxDuringTx
+		}
+		rs.delayRTSBeforeSend = uint32(rc.DelayBeforeSend / time.Millisecond)
+		rs.delayRTSAfterSend = uint32(rc.DelayAfterSend / time.Millisecond)
+	}
+	err := p.ioctl(unix.TIOCSRS485, uintptr(unsafe.Pointer(&rs)))
+	switch {
+	case err == nil:
+		p.rs485 = nil
+		return nil
+	case err != unix.ENOTTY && err != unix.EINVAL:
+		return err
+	case rc == nil:
+		// Nothing to turn off.
+		p.rs485 = nil
+		return nil
+	}
+	p.rs485 = rc
+	return p.SetRTS(rc.RTSAfterSend)
+}
+
+// serialRS485 mirrors the kernel's struct serial_rs485.
+type serialRS485 struct {
+	flags              uint32
+	delayRTSBeforeSend uint32 // milliseconds
+	delayRTSAfterSend  uint32 // milliseconds
+	padding            [5]uint32
+}
+
+// Flags for serialRS485.
+const (
+	serRS485Enabled      = 1 << 0
+	serRS485RTSOnSend    = 1 << 1
+	serRS485RTSAfterSend = 1 << 2
+	serRS485RxDuringTx   = 1 << 4
+)
+
+// setReportErrors switches between reading the port directly and
+// decoding the line errors marked in the input.
+func (p *Port) setReportErrors(on bool) {
+	if !on {
+		p.lr = nil
+	} else if p.lr == nil {
+		p.lr = &lineErrorReader{r: readerFunc(p.readFile), onBreak: p.onBreak}
+	}
+}
+
+// Config returns the settings currently in effect on the port, as
+// reported by the driver.
+func (p *Port) Config() (*Config, error) {
+	var t *unix.Termios
+	err := p.control(func(fd uintptr) (err error) {
+		t, err = getTermios(fd)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := configFromTermios(t)
+	c.Name = p.c.Name
+	c.ReadTimeout = p.c.ReadTimeout
+	c.InterCharTimeout = p.c.InterCharTimeout
+	c.WriteTimeout = p.c.WriteTimeout
+	return c, nil
 }
 
 // Discards data written to the port but not transmitted,
 // or data received but not read
 func (p *Port) Flush() error {
-	const TCFLSH = 0x540B
-	_, _, errno := unix.Syscall(
-		unix.SYS_IOCTL,
-		uintptr(p.f.Fd()),
-		uintptr(TCFLSH),
-		uintptr(unix.TCIOFLUSH),
-	)
-
-	if errno == 0 {
-		return nil
+	p.discardInput()
+	return p.ioctl(unix.TCFLSH, uintptr(unix.TCIOFLUSH))
+}
+
+// FlushInput discards data received but not read.
+func (p *Port) FlushInput() error {
+	p.discardInput()
+	return p.ioctl(unix.TCFLSH, uintptr(unix.TCIFLUSH))
+}
+
+// FlushOutput discards data written to the port but not transmitted.
+func (p *Port) FlushOutput() error {
+	return p.ioctl(unix.TCFLSH, uintptr(unix.TCOFLUSH))
+}
+
+// InputWaiting returns the number of bytes received but not read.
+func (p *Port) InputWaiting() (int, error) {
+	var n int32
+	err := p.ioctl(unix.TIOCINQ, uintptr(unsafe.Pointer(&n)))
+	return int(n) + p.bufferedInput(), err
+}
+
+// OutputWaiting returns the number of bytes written to the port but not
+// transmitted yet.
+func (p *Port) OutputWaiting() (int, error) {
+	var n int32
+	err := p.ioctl(unix.TIOCOUTQ, uintptr(unsafe.Pointer(&n)))
+	return int(n), err
+}
+
+// SuspendOutput stops transmitting, as if the peer had sent XOFF, until
+// ResumeOutput is called.
+func (p *Port) SuspendOutput() error {
+	return p.ioctl(unix.TCXONC, unix.TCOOFF)
+}
+
+// ResumeOutput restarts output stopped by SuspendOutput.
+func (p *Port) ResumeOutput() error {
+	return p.ioctl(unix.TCXONC, unix.TCOON)
+}
+
+// SuspendInput transmits the XOFF character, asking the peer to stop
+// sending.
+func (p *Port) SuspendInput() error {
+	return p.ioctl(unix.TCXONC, unix.TCIOFF)
+}
+
+// ResumeInput transmits the XON character, asking the peer to resume
+// sending.
+func (p *Port) ResumeInput() error {
+	return p.ioctl(unix.TCXONC, unix.TCION)
+}
+
+// SetDTR raises (on) or lowers the DTR line.
+func (p *Port) SetDTR(on bool) error {
+	return p.setModemLines(unix.TIOCM_DTR, on)
+}
+
+// SetRTS raises (on) or lowers the RTS line.
+func (p *Port) SetRTS(on bool) error {
+	return p.setModemLines(unix.TIOCM_RTS, on)
+}
+
+// ModemStatus returns the current state of the modem status lines.
+func (p *Port) ModemStatus() (ModemStatus, error) {
+	var bits int32
+	if err := p.modemIoctl(unix.TIOCMGET, uintptr(unsafe.Pointer(&bits))); err != nil {
+		return ModemStatus{}, err
+	}
+	return ModemStatus{
+		CTS: bits&unix.TIOCM_CTS != 0,
+		DSR: bits&unix.TIOCM_DSR != 0,
+		DCD: bits&unix.TIOCM_CAR != 0,
+		RI:  bits&unix.TIOCM_RNG != 0,
+	}, nil
+}
+
+// modemPollInterval is how often a modemWatcher reads the lines. The
+// kernel's TIOCMIWAIT would wait without polling, but neither Close nor
+// a context can interrupt it, and the descriptor it waits on keeps the
+// port open. Polling costs two ioctls per interval while someone waits,
+// and delays events by up to one interval; the interrupt counters still
+// catch changes shorter than that.
+const modemPollInterval = 10 * time.Millisecond
+
+// modemSample is a reading of the modem lines and, if the driver keeps
+// them, of their interrupt counters.
+type modemSample struct {
+	status  ModemStatus
+	counts  serialIcounter
+	counted bool
+}
+
+// changed returns the lines that changed between s and the later
+// sample next. The counters also catch pulses, such as a ring, that
+// are over by the time the lines are read again.
+func (s *modemSample) changed(next *modemSample) ModemStatus {
+	if s.counted && next.counted {
+		return ModemStatus{
+			CTS: next.counts.cts != s.counts.cts,
+			DSR: next.counts.dsr != s.counts.dsr,
+			DCD: next.counts.dcd != s.counts.dcd,
+			RI:  next.counts.rng != s.counts.rng,
+		}
+	}
+	return next.status.diff(s.status)
+}
+
+// modemWatcher reports the changes of the modem lines since the last
+// one it reported, so that none are lost between two waits.
+type modemWatcher struct {
+	last   modemSample
+	sample func() (modemSample, error)
+}
+
+func (p *Port) newModemWatcher() (*modemWatcher, error) {
+	w := &modemWatcher{sample: p.modemSample}
+	var err error
+	if w.last, err = w.sample(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// modemSample reads the modem lines and their counters. After Close it
+// fails with ErrClosed.
+func (p *Port) modemSample() (modemSample, error) {
+	var s modemSample
+	var err error
+	if s.status, err = p.ModemStatus(); err != nil {
+		return s, err
+	}
+	s.counted = p.ioctl(unix.TIOCGICOUNT, uintptr(unsafe.Pointer(&s.counts))) == nil
+	return s, nil
+}
+
+// wait returns the next change of the lines, or ctx.Err() if ctx is
+// done first.
+func (w *modemWatcher) wait(ctx context.Context) (ModemEvent, error) {
+	t := time.NewTicker(modemPollInterval)
+	defer t.Stop()
+	for {
+		s, err := w.sample()
+		if err != nil {
+			return ModemEvent{}, err
+		}
+		if changed := w.last.changed(&s); changed != (ModemStatus{}) {
+			w.last = s
+			return ModemEvent{Time: time.Now(), Status: s.status, Changed: changed}, nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ModemEvent{}, ctx.Err()
+		}
 	}
-	return errno
 }
 
+// serialIcounter mirrors the kernel's struct serial_icounter_struct.
+type serialIcounter struct {
+	cts, dsr, rng, dcd int32
+	rx, tx             int32
+	frame, overrun     int32
+	parity, brk        int32
+	bufOverrun         int32
+	reserved           [9]int32
+}
+
+func (p *Port) setModemLines(bits int32, on bool) error {
+	req := uint(unix.TIOCMBIC)
+	if on {
+		req = unix.TIOCMBIS
+	}
+	return p.modemIoctl(req, uintptr(unsafe.Pointer(&bits)))
+}
+
+// setExclusive makes further opens of the port fail, and flocks it for
+// the benefit of processes running as root, which TIOCEXCL doesn't
+// stop.
+func (p *Port) setExclusive() error {
+	return p.control(func(fd uintptr) error {
+		if err := ioctl(fd, unix.TIOCEXCL, 0); err != nil {
+			return err
+		}
+		err := unix.Flock(int(fd), unix.LOCK_EX|unix.LOCK_NB)
+		if err == unix.EWOULDBLOCK {
+			return &PortBusyError{Name: p.c.Name, PID: flockHolder(fd)}
+		}
+		return err
+	})
+}
+
+// flockHolder returns the PID of the process holding an flock on the
+// file fd refers to, according to /proc/locks, or 0 if it can't tell.
+func flockHolder(fd uintptr) int {
+	var st unix.Stat_t
+	if err := unix.Fstat(int(fd), &st); err != nil {
+		return 0
+	}
+	return lockHolder(&st)
+}
+
+// deviceHolder is like flockHolder, for the device name. Exclusive
+// ports are flocked as well as opened with TIOCEXCL, so this finds the
+// process that made opening name fail with EBUSY.
+func deviceHolder(name string) int {
+	var st unix.Stat_t
+	if err := unix.Stat(name, &st); err != nil {
+		return 0
+	}
+	return lockHolder(&st)
+}
+
+// lockHolder returns the PID of the process holding an flock on the
+// file st describes, according to /proc/locks, or 0 if it can't tell.
+func lockHolder(st *unix.Stat_t) int {
+	b, err := ioutil.ReadFile("/proc/locks")
+	if err != nil {
+		return 0
+	}
+	// 1: FLOCK  ADVISORY  WRITE 1234 00:05:3 0 EOF
+	file := fmt.Sprintf("%02x:%02x:%d", unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev)), st.Ino)
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		if len(f) < 6 || f[1] != "FLOCK" || f[5] != file {
+			continue
+		}
+		if pid, err := strconv.Atoi(f[4]); err == nil {
+			return pid
+		}
+	}
+	return 0
+}
+
+// SetBreak starts transmitting a break condition, which lasts until
+// ClearBreak is called. Output already written is transmitted first.
+func (p *Port) SetBreak() error {
+	// The kernel waits for the output queue without limit before the
+	// break, and Close would wait for it. Empty the queue here instead,
+	// where Close ends the wait, and keep Writes from refilling it.
+	release, err := p.holdOutput(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+	if err := p.waitOutput(context.Background()); err != nil {
+		return err
+	}
+	return p.ioctl(unix.TIOCSBRK, 0)
+}
+
+// ClearBreak stops transmitting a break condition.
+func (p *Port) ClearBreak() error {
+	return p.ioctl(unix.TIOCCBRK, 0)
+}
+
+// waitSent waits for the last characters, which have left the output
+// queue but may still be in the UART, to be transmitted. drain calls it
+// with the queue empty and Writes held off, and the driver then bounds
+// the wait by the size of its FIFO; with output queued, the wait has
+// no limit.
+func (p *Port) waitSent() error {
+	// TCSBRK with a non-zero argument is tcdrain.
+	return p.ioctl(unix.TCSBRK, 1)
+}
+
+// restoreTermios restores the settings the port had before it was
+// opened. HUPCL is left as HangupOnClose says, since the original
+// settings usually have it set and would hang up the line on Close.
+func (p *Port) restoreTermios() error {
+	t := *p.orig
+	t.Cflag &^= unix.HUPCL
+	if p.c.HangupOnClose {
+		t.Cflag |= unix.HUPCL
+	}
+	return p.control(func(fd uintptr) error {
+		return ioctl(fd, tcsets2, uintptr(unsafe.Pointer(&t)))
+	})
+}
+
+// Close closes the port. Reads and Writes blocked on the port return
+// ErrClosed.
 func (p *Port) Close() (err error) {
-	return p.f.Close()
+	return p.closeFile()
+}
+
+// ioctl issues the request req with argument arg on the port. req must
+// not block.
+func (p *Port) ioctl(req uint, arg uintptr) error {
+	return p.control(func(fd uintptr) error {
+		return ioctl(fd, req, arg)
+	})
+}
+
+// modemIoctl is like ioctl, but reports the errors returned by drivers
+// without modem control lines, such as ptys, as ErrNotSupported.
+func (p *Port) modemIoctl(req uint, arg uintptr) error {
+	return p.control(func(fd uintptr) error {
+		return modemError(ioctl(fd, req, arg))
+	})
+}
+
+// modemError maps the errors returned by drivers without modem control
+// lines to ErrNotSupported.
+func modemError(err error) error {
+	if err == unix.ENOTTY || err == unix.EINVAL {
+		return ErrNotSupported
+	}
+	return err
+}
+
+// ioctl issues the request req with argument arg on fd.
+func ioctl(fd uintptr, req uint, arg uintptr) error {
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, uintptr(req), arg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
 }
@@ -0,0 +1,852 @@
+// +build linux
+
+package serial
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// openPty opens a pseudo terminal, returning the master side and the
+// name of the slave, which can be opened as a Port.
+func openPty(t *testing.T) (*os.File, string) {
+	m, err := os.OpenFile("/dev/ptmx", os.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("no pseudo terminals:", err)
+	}
+	var unlock int32
+	if err := ioctl(m.Fd(), unix.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetUint32(int(m.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	return m, "/dev/pts/" + strconv.Itoa(int(n))
+}
+
+// closeWhileBlocked calls Close once op has had time to block, and
+// returns the error op returned.
+func closeWhileBlocked(t *testing.T, p *Port, op func() error) error {
+	errc := make(chan error, 1)
+	go func() { errc <- op() }()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case err := <-errc:
+		t.Fatalf("returned before Close: %v", err)
+	default:
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("still blocked after Close")
+	}
+	return nil
+}
+
+func TestCloseUnblocksRead(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = closeWhileBlocked(t, p, func() error {
+		_, err := p.Read(make([]byte, 16))
+		return err
+	})
+	if err != ErrClosed {
+		t.Errorf("Read returned %v, want ErrClosed", err)
+	}
+}
+
+func TestCloseUnblocksWrite(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nobody reads the master side, so Write blocks once the pty's
+	// buffers are full.
+	err = closeWhileBlocked(t, p, func() error {
+		_, err := p.Write(make([]byte, 1<<20))
+		return err
+	})
+	if err != ErrClosed {
+		t.Errorf("Write returned %v, want ErrClosed", err)
+	}
+}
+
+func TestUseAfterClose(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Read(make([]byte, 1)); err != ErrClosed {
+		t.Errorf("Read returned %v, want ErrClosed", err)
+	}
+	if _, err := p.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write returned %v, want ErrClosed", err)
+	}
+	if err := p.SetRTS(true); err != ErrClosed {
+		t.Errorf("SetRTS returned %v, want ErrClosed", err)
+	}
+	if err := p.Close(); err != ErrClosed {
+		t.Errorf("second Close returned %v, want ErrClosed", err)
+	}
+}
+
+// writeBursts writes each burst to w, pausing between them.
+func writeBursts(w io.Writer, pause time.Duration, bursts ...string) {
+	for i, s := range bursts {
+		if i > 0 {
+			time.Sleep(pause)
+		}
+		w.Write([]byte(s))
+	}
+}
+
+func TestInterCharTimeout(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600, InterCharTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	go writeBursts(m, 20*time.Millisecond, "abc", "def")
+	buf := make([]byte, 64)
+	n, err := p.Read(buf)
+	if err != nil || string(buf[:n]) != "abcdef" {
+		t.Errorf("Read returned %q, %v, want %q", buf[:n], err, "abcdef")
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// 200 character times at 9600 baud are about 200ms.
+	go writeBursts(m, 500*time.Millisecond, "one", "two")
+	buf := make([]byte, 64)
+	for _, want := range []string{"one", "two"} {
+		n, err := p.ReadFrame(buf, 200)
+		if err != nil || string(buf[:n]) != want {
+			t.Errorf("ReadFrame returned %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+}
+
+func TestReadTimeout(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600, ReadTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	n, err := p.Read(make([]byte, 16))
+	if n != 0 || err != ErrTimeout {
+		t.Fatalf("Read returned %d, %v, want 0, ErrTimeout", n, err)
+	}
+	if te, ok := err.(interface{ Timeout() bool }); !ok || !te.Timeout() {
+		t.Errorf("ErrTimeout is not a timeout")
+	}
+}
+
+func TestReadDisconnected(t *testing.T) {
+	m, name := openPty(t)
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Closing the master side hangs up the slave.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.Close()
+	}()
+	if _, err := p.Read(make([]byte, 16)); err != ErrDisconnected {
+		t.Errorf("Read returned %v, want ErrDisconnected", err)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600, WriteTimeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Nobody reads the master side, so only the pty's buffers are
+	// written.
+	b := make([]byte, 1<<20)
+	n, err := p.Write(b)
+	if err != ErrTimeout {
+		t.Fatalf("Write returned %v, want ErrTimeout", err)
+	}
+	if n <= 0 || n >= len(b) {
+		t.Errorf("Write wrote %d of %d bytes", n, len(b))
+	}
+}
+
+func TestDrain(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	if _, err := p.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Drain(context.Background()); err != nil {
+		t.Errorf("Drain: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Drain(ctx); err != context.Canceled {
+		t.Errorf("Drain returned %v, want context.Canceled", err)
+	}
+}
+
+func TestSetBaud(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	// 250000 has no Bnnn constant and needs BOTHER.
+	p, err := OpenPort(&Config{Name: name, Baud: 250000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, baud := range []int{250000, 31250, 9600} {
+		if baud != 250000 {
+			if err := p.SetBaud(baud); err != nil {
+				t.Fatalf("SetBaud(%d): %v", baud, err)
+			}
+		}
+		if got := p.Baud(); got != baud {
+			t.Errorf("Baud() = %d, want %d", got, baud)
+		}
+		c, err := p.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Baud != baud {
+			t.Errorf("Config().Baud = %d, want %d", c.Baud, baud)
+		}
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	want := Config{
+		Name:           name,
+		Baud:           19200,
+		ReadTimeout:    100 * time.Millisecond,
+		Size:           8,
+		Parity:         ParityNone,
+		StopBits:       Stop2,
+		RTSFlowControl: true,
+		XONFlowControl: true,
+		XONAny:         true,
+		XONChar:        DefaultXONChar,
+		XOFFChar:       DefaultXOFFChar,
+	}
+	for _, flow := range []bool{true, false} {
+		want.RTSFlowControl, want.XONFlowControl, want.XONAny = flow, flow, flow
+		c := want
+		if err := p.SetConfig(&c); err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.Config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != want {
+			t.Errorf("Config() = %+v, want %+v", got, &want)
+		}
+	}
+}
+
+func TestMarkSpaceParity(t *testing.T) {
+	// WriteAddressed relies on these; pseudo terminals can't keep them.
+	for _, parity := range []Parity{ParityMark, ParitySpace} {
+		tios, err := makeTermios(&Config{Baud: 9600, Size: 8, Parity: parity, StopBits: Stop1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := configFromTermios(tios).Parity; got != parity {
+			t.Errorf("parity %c decoded as %c", parity, got)
+		}
+	}
+}
+
+func TestDrainStalled(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SuspendOutput(); err != nil {
+		t.Fatal(err)
+	}
+	go p.Write(make([]byte, 64<<10))
+	time.Sleep(50 * time.Millisecond)
+
+	// The stalled Write keeps Drain waiting until ctx is done or the
+	// port is closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain returned %v, want context.DeadlineExceeded", err)
+	}
+	err = closeWhileBlocked(t, p, func() error {
+		return p.Drain(context.Background())
+	})
+	if err != ErrClosed {
+		t.Errorf("Drain returned %v, want ErrClosed", err)
+	}
+}
+
+// Pseudo terminals have no parity bit and silently drop the parity
+// flags, which must not go unnoticed.
+func TestUnsupportedParity(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	if _, err := OpenPort(&Config{Name: name, Baud: 9600, Parity: ParityEven}); err != ErrBadParity {
+		t.Errorf("OpenPort with even parity returned %v, want ErrBadParity", err)
+	}
+
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	n, err := p.WriteAddressed(0x42, []byte("hi"))
+	if n != 0 || err != ErrBadParity {
+		t.Errorf("WriteAddressed returned %d, %v, want 0, ErrBadParity", n, err)
+	}
+
+	// A rejected change leaves the previous settings in place.
+	if err := p.SetConfig(&Config{Baud: 19200, Parity: ParityEven}); err != ErrBadParity {
+		t.Errorf("SetConfig with even parity returned %v, want ErrBadParity", err)
+	}
+	c, err := p.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Baud != 9600 || p.Baud() != 9600 {
+		t.Errorf("after a failed SetConfig, Config().Baud = %d and Baud() = %d, want 9600", c.Baud, p.Baud())
+	}
+}
+
+func TestFlushInput(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	m.Write([]byte("hello"))
+	time.Sleep(50 * time.Millisecond)
+	if n, err := p.InputWaiting(); n != 5 || err != nil {
+		t.Errorf("InputWaiting returned %d, %v, want 5", n, err)
+	}
+	if err := p.FlushInput(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := p.InputWaiting(); n != 0 || err != nil {
+		t.Errorf("InputWaiting returned %d, %v after FlushInput, want 0", n, err)
+	}
+	if err := p.FlushOutput(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.OutputWaiting(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSuspendOutput(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	got := make(chan string, 4)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, err := m.Read(buf)
+			if err != nil {
+				return
+			}
+			got <- string(buf[:n])
+		}
+	}()
+
+	if err := p.SuspendInput(); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "\x13" {
+		t.Errorf("SuspendInput sent %q, want XOFF", s)
+	}
+	if err := p.SuspendOutput(); err != nil {
+		t.Fatal(err)
+	}
+	// Write blocks until output is resumed.
+	go p.Write([]byte("held"))
+	select {
+	case s := <-got:
+		t.Fatalf("got %q while output was suspended", s)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := p.ResumeOutput(); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-got; s != "held" {
+		t.Errorf("got %q after ResumeOutput, want %q", s, "held")
+	}
+}
+
+func TestExclusive(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600, Exclusive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// For root, TIOCEXCL doesn't apply, but the flock does.
+	_, err = OpenPort(&Config{Name: name, Baud: 9600, Exclusive: true})
+	var busy *PortBusyError
+	if !errors.As(err, &busy) {
+		t.Fatalf("second open returned %v, want a *PortBusyError", err)
+	}
+	if busy.PID != os.Getpid() {
+		t.Errorf("port held by %d, want %d", busy.PID, os.Getpid())
+	}
+	// Without root, the open itself fails with EBUSY.
+	err = busyError(name, syscall.EBUSY)
+	if !errors.As(err, &busy) || busy.PID != os.Getpid() {
+		t.Errorf("busyError returned %v, want PID %d", err, os.Getpid())
+	}
+
+	p.Close()
+	p, err = OpenPort(&Config{Name: name, Baud: 9600, Exclusive: true})
+	if err != nil {
+		t.Fatalf("open after Close: %v", err)
+	}
+	p.Close()
+}
+
+func TestRestoreOnClose(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	// Real serial ports start out with HUPCL set.
+	p1, err := OpenPort(&Config{Name: name, Baud: 4800, HangupOnClose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p1.Close()
+
+	p2, err := OpenPort(&Config{Name: name, Baud: 19200, RestoreOnClose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := p1.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Baud != 19200 || c.HangupOnClose {
+		t.Errorf("open port has baud %d, HUPCL %v, want 19200, false", c.Baud, c.HangupOnClose)
+	}
+	if err := p2.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = p1.Config(); err != nil {
+		t.Fatal(err)
+	}
+	// The baud rate is restored, but HUPCL follows HangupOnClose.
+	if c.Baud != 4800 || c.HangupOnClose {
+		t.Errorf("closed port has baud %d, HUPCL %v, want 4800, false", c.Baud, c.HangupOnClose)
+	}
+}
+
+func TestRestoreOnCloseStalled(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600, RestoreOnClose: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Output stopped as if by XOFF must not keep Close from returning.
+	if err := p.SuspendOutput(); err != nil {
+		t.Fatal(err)
+	}
+	err = closeWhileBlocked(t, p, func() error {
+		_, err := p.Write(make([]byte, 64<<10))
+		return err
+	})
+	if err != ErrClosed {
+		t.Errorf("Write returned %v, want ErrClosed", err)
+	}
+}
+
+func TestIdentifyPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// An FT2232 with two ports sharing its serial number, and an
+	// FT232R.
+	const dual = "devices/pci0000:00/0000:00:14.0/usb1/1-2"
+	const single = "devices/pci0000:00/0000:00:14.0/usb1/1-3"
+	files := map[string]string{
+		dual + "/idVendor":    "0403\n",
+		dual + "/idProduct":   "6010\n",
+		dual + "/serial":      "FT2232X\n",
+		single + "/idVendor":  "0403\n",
+		single + "/idProduct": "6001\n",
+		single + "/serial":    "A600XYZ\n",
+	}
+	for _, tty := range []struct{ usb, intf, name string }{
+		{dual, "1-2:1.0", "ttyUSB0"},
+		{dual, "1-2:1.1", "ttyUSB1"},
+		{single, "1-3:1.0", "ttyUSB2"},
+	} {
+		files[tty.usb+"/"+tty.intf+"/bInterfaceNumber"] = tty.intf[len(tty.intf)-1:] + "\n"
+		files[tty.usb+"/"+tty.intf+"/"+tty.name+"/tty/"+tty.name+"/device"] = "->../../../" + tty.name
+		files["class/tty/"+tty.name] = "->../../" + tty.usb + "/" + tty.intf + "/" + tty.name + "/tty/" + tty.name
+	}
+	fakeSysfs(t, dir, files)
+	ports, err := listPorts(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want *PortMatch
+	}{
+		{"/dev/ttyUSB0", &PortMatch{VID: 0x0403, PID: 0x6010, Location: "1-2:1.0"}},
+		{"/dev/ttyUSB1", &PortMatch{VID: 0x0403, PID: 0x6010, Location: "1-2:1.1"}},
+		{"/dev/ttyUSB2", &PortMatch{VID: 0x0403, PID: 0x6001, SerialNumber: "A600XYZ"}},
+		{"/dev/ttyS0", nil},
+	}
+	for _, tt := range tests {
+		got := identifyPort(tt.name, ports)
+		if got == nil || tt.want == nil {
+			if got != tt.want {
+				t.Errorf("%s: identified as %v, want %v", tt.name, got, tt.want)
+			}
+		} else if *got != *tt.want {
+			t.Errorf("%s: identified as %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResilientPort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "resilient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The port is opened through a symlink, which is pointed at a new
+	// pty to plug the device back in.
+	link := filepath.Join(dir, "ttyTEST")
+	m, name := openPty(t)
+	defer m.Close()
+	if err := os.Symlink(name, link); err != nil {
+		t.Fatal(err)
+	}
+
+	states := make(chan ConnState, 100)
+	r, err := OpenResilientPort(&Config{Name: link, Baud: 9600}, &ResilientConfig{
+		MinBackoff:    10 * time.Millisecond,
+		MaxBackoff:    50 * time.Millisecond,
+		OnStateChange: func(s ConnState, err error) { states <- s },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	waitState := func(want ConnState) {
+		t.Helper()
+		for {
+			select {
+			case s := <-states:
+				if s == want {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("state did not change to %v", want)
+			}
+		}
+	}
+	expectRead := func(want string) {
+		t.Helper()
+		buf := make([]byte, 16)
+		n, err := r.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("Read returned %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+
+	m.Write([]byte("one"))
+	expectRead("one")
+
+	m.Close()
+	if _, err := r.Read(make([]byte, 16)); err != ErrDisconnected {
+		t.Fatalf("Read returned %v, want ErrDisconnected", err)
+	}
+	waitState(StateDisconnected)
+	waitState(StateReconnecting)
+
+	m, name = openPty(t)
+	defer m.Close()
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(name, link); err != nil {
+		t.Fatal(err)
+	}
+	waitState(StateConnected)
+	m.Write([]byte("two"))
+	expectRead("two")
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitState(StateClosed)
+	if _, err := r.Read(make([]byte, 16)); err != ErrClosed {
+		t.Errorf("Read after Close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestResilientPortTimeout(t *testing.T) {
+	m, name := openPty(t)
+	r, err := OpenResilientPort(&Config{Name: name, Baud: 9600, ReadTimeout: 50 * time.Millisecond}, nil)
+	if err != nil {
+		m.Close()
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	m.Close()
+	if _, err := r.Read(make([]byte, 16)); err != ErrDisconnected {
+		t.Fatalf("Read returned %v, want ErrDisconnected", err)
+	}
+	// The pty is gone for good, so the next Read can only time out.
+	start := time.Now()
+	if _, err := r.Read(make([]byte, 16)); err != ErrTimeout {
+		t.Errorf("Read while disconnected returned %v, want ErrTimeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Read while disconnected took %v", d)
+	}
+}
+
+// fakeModem returns a modemWatcher that reads the given samples in
+// turn, repeating the last one.
+func fakeModem(first modemSample, samples ...modemSample) *modemWatcher {
+	return &modemWatcher{
+		last: first,
+		sample: func() (modemSample, error) {
+			s := samples[0]
+			if len(samples) > 1 {
+				samples = samples[1:]
+			}
+			return s, nil
+		},
+	}
+}
+
+func TestModemWatcher(t *testing.T) {
+	var idle, cts, ring modemSample
+	idle.counted = true
+	cts = idle
+	cts.status.CTS = true
+	cts.counts.cts++
+	// A ring that is over before the next sample, with DCD raised.
+	ring = cts
+	ring.status.DCD = true
+	ring.counts.dcd++
+	ring.counts.rng += 2
+
+	w := fakeModem(idle, idle, idle, cts, ring)
+	ev, err := w.wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ModemStatus{CTS: true}); ev.Status != want || ev.Changed != want {
+		t.Errorf("first event %+v, want CTS raised", ev)
+	}
+	// The ring happened while nobody waited, and still counts.
+	if ev, err = w.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Status != (ModemStatus{CTS: true, DCD: true}) || ev.Changed != (ModemStatus{DCD: true, RI: true}) {
+		t.Errorf("second event %+v, want DCD raised and a ring", ev)
+	}
+
+	// Nothing changes any more.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*modemPollInterval)
+	defer cancel()
+	if ev, err = w.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("wait returned %+v, %v, want context.DeadlineExceeded", ev, err)
+	}
+
+	// Without counters, the lines are compared.
+	var dsr modemSample
+	dsr.status.DSR = true
+	w = fakeModem(modemSample{}, modemSample{}, dsr)
+	if ev, err = w.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ModemStatus{DSR: true}); ev.Status != want || ev.Changed != want {
+		t.Errorf("uncounted event %+v, want DSR raised", ev)
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	past := time.Now().Add(-time.Second)
+	if err := p.SetDeadline(past); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read past the deadline returned %v, want os.ErrDeadlineExceeded", err)
+	}
+	if _, err := p.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write past the deadline returned %v, want os.ErrDeadlineExceeded", err)
+	}
+
+	// A deadline that passes while Read waits ends it.
+	if err := p.SetDeadline(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read returned %v, want os.ErrDeadlineExceeded", err)
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Without a deadline, only cancelling ends the Read.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := p.ReadContext(ctx, make([]byte, 16)); err != context.Canceled {
+		t.Errorf("ReadContext returned %v, want context.Canceled", err)
+	}
+
+	// A deadline set beforehand is replaced, and cleared afterwards.
+	if err := p.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	m.Write([]byte("one"))
+	n, err := p.ReadContext(context.Background(), buf)
+	if err != nil || string(buf[:n]) != "one" {
+		t.Errorf("ReadContext returned %q, %v, want %q", buf[:n], err, "one")
+	}
+	m.Write([]byte("two"))
+	n, err = p.Read(buf)
+	if err != nil || string(buf[:n]) != "two" {
+		t.Errorf("Read after ReadContext returned %q, %v, want %q", buf[:n], err, "two")
+	}
+}
+
+func TestWriteContext(t *testing.T) {
+	m, name := openPty(t)
+	defer m.Close()
+	p, err := OpenPort(&Config{Name: name, Baud: 9600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Nobody reads the master, so the pty takes part of the data and
+	// then makes the Write wait.
+	b := make([]byte, 1<<20)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	n, err := p.WriteContext(ctx, b)
+	if err != context.DeadlineExceeded {
+		t.Errorf("WriteContext returned %v, want context.DeadlineExceeded", err)
+	}
+	if n <= 0 || n >= len(b) {
+		t.Errorf("WriteContext wrote %d bytes, want part of %d", n, len(b))
+	}
+}
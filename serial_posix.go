@@ -4,95 +4,154 @@ package serial
 
 // #include <termios.h>
 // #include <unistd.h>
+// #include <sys/ioctl.h>
+// #include <sys/file.h>
+//
+// // ioctl is variadic, which cgo cannot call directly.
+// static int ioctl_int(int fd, unsigned long req, int *arg) {
+// 	return ioctl(fd, req, arg);
+// }
 import "C"
 
 // TODO: Maybe change to using syscall package + ioctl instead of cgo
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"syscall"
-	"time"
 	//"unsafe"
 )
 
-func openPort(name string, baud int, databits byte, parity Parity, stopbits StopBits, readTimeout time.Duration) (p *Port, err error) {
-	f, err := os.OpenFile(name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0666)
+var bauds = map[int]C.speed_t{
+	50:     C.B50,
+	75:     C.B75,
+	110:    C.B110,
+	134:    C.B134,
+	150:    C.B150,
+	200:    C.B200,
+	300:    C.B300,
+	600:    C.B600,
+	1200:   C.B1200,
+	2400:   C.B2400,
+	4800:   C.B4800,
+	9600:   C.B9600,
+	19200:  C.B19200,
+	38400:  C.B38400,
+	57600:  C.B57600,
+	115200: C.B115200,
+}
+
+func openPort(c *Config) (p *Port, err error) {
+	var lock *uucpLock
+	if c.Lock {
+		if lock, err = lockUUCP(c.LockDir, c.Name); err != nil {
+			return nil, err
+		}
+		defer func() {
+			if err != nil {
+				lock.unlock()
+			}
+		}()
+	}
+
+	f, err := os.OpenFile(c.Name, syscall.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0666)
 	if err != nil {
-		return
+		return nil, busyError(c.Name, err)
 	}
 
-	fd := C.int(f.Fd())
-	if C.isatty(fd) != 1 {
+	rc, err := f.SyscallConn()
+	if err != nil {
 		f.Close()
-		return nil, errors.New("File is not a tty")
+		return nil, err
 	}
+	p = &Port{f: f, rc: rc, c: c, lock: lock, sending: make(chan struct{}, 1)}
 
-	var st C.struct_termios
-	_, err = C.tcgetattr(fd, &st)
+	if c.Exclusive {
+		if err = p.setExclusive(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	err = p.control(func(fd uintptr) error {
+		if C.isatty(C.int(fd)) != 1 {
+			return errors.New("File is not a tty")
+		}
+		if _, err := C.tcgetattr(C.int(fd), &p.orig); err != nil {
+			return err
+		}
+		return setTermios(C.int(fd), c)
+	})
 	if err != nil {
 		f.Close()
 		return nil, err
 	}
-	var speed C.speed_t
-	switch baud {
-	case 115200:
-		speed = C.B115200
-	case 57600:
-		speed = C.B57600
-	case 38400:
-		speed = C.B38400
-	case 19200:
-		speed = C.B19200
-	case 9600:
-		speed = C.B9600
-	case 4800:
-		speed = C.B4800
-	case 2400:
-		speed = C.B2400
-	case 1200:
-		speed = C.B1200
-	case 600:
-		speed = C.B600
-	case 300:
-		speed = C.B300
-	case 200:
-		speed = C.B200
-	case 150:
-		speed = C.B150
-	case 134:
-		speed = C.B134
-	case 110:
-		speed = C.B110
-	case 75:
-		speed = C.B75
-	case 50:
-		speed = C.B50
-	default:
-		f.Close()
-		return nil, fmt.Errorf("Unknown baud rate %v", baud)
+
+	// The descriptor stays in non-blocking mode, see serial_unix.go.
+
+	/*
+				r1, _, e = syscall.Syscall(syscall.SYS_IOCTL,
+			                uintptr(f.Fd()),
+			                uintptr(0x80045402), // IOSSIOSPEED
+			                uintptr(unsafe.Pointer(&baud)));
+			        if e != 0 || r1 != 0 {
+			                s := fmt.Sprint("Baudrate syscall error:", e, r1)
+					f.Close()
+		                        return nil, os.NewError(s)
+				}
+	*/
+
+	p.setReportErrors(c.ReportErrors)
+	if c.RS485 != nil {
+		if err = p.SetRTS(c.RS485.RTSAfterSend); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// setTermios applies the settings in c to the terminal fd.
+func setTermios(fd C.int, c *Config) error {
+	var st C.struct_termios
+	_, err := C.tcgetattr(fd, &st)
+	if err != nil {
+		return err
+	}
+	speed, ok := bauds[c.Baud]
+	if !ok {
+		return fmt.Errorf("Unknown baud rate %v", c.Baud)
 	}
 
 	_, err = C.cfsetispeed(&st, speed)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
 	_, err = C.cfsetospeed(&st, speed)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
 
 	// Turn off break interrupts, CR->NL, Parity checks, strip, and IXON
 	st.c_iflag &= ^C.tcflag_t(C.BRKINT | C.ICRNL | C.INPCK | C.ISTRIP | C.IXOFF | C.IXON | C.PARMRK)
+	if c.ReportErrors {
+		// Mark breaks and bad bytes in the input for lineErrorReader.
+		st.c_iflag &= ^C.tcflag_t(C.IGNBRK | C.IGNPAR)
+		st.c_iflag |= C.INPCK | C.PARMRK
+	}
 
 	// Select local mode, turn off parity, set to 8 bits
 	st.c_cflag &= ^C.tcflag_t(C.CSIZE | C.PARENB)
 	st.c_cflag |= (C.CLOCAL | C.CREAD)
+	if c.HangupOnClose {
+		st.c_cflag |= C.HUPCL
+	} else {
+		st.c_cflag &= ^C.tcflag_t(C.HUPCL)
+	}
 	// databits
-	switch databits {
+	switch c.Size {
 	case 5:
 		st.c_cflag |= C.CS5
 	case 6:
@@ -102,10 +161,10 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 	case 8:
 		st.c_cflag |= C.CS8
 	default:
-		return nil, ErrBadSize
+		return ErrBadSize
 	}
 	// Parity settings
-	switch parity {
+	switch c.Parity {
 	case ParityNone:
 		// default is no parity
 	case ParityOdd:
@@ -115,83 +174,400 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 		st.c_cflag |= C.PARENB
 		st.c_cflag &= ^C.tcflag_t(C.PARODD)
 	default:
-		return nil, ErrBadParity
+		return ErrBadParity
 	}
 	// Stop bits settings
-	switch stopbits {
+	switch c.StopBits {
 	case Stop1:
 		// as is, default is 1 bit
 	case Stop2:
 		st.c_cflag |= C.CSTOPB
 	default:
-		return nil, ErrBadStopBits
+		return ErrBadStopBits
+	}
+	// Flow control settings
+	if c.RTSFlowControl {
+		if c.RS485 != nil {
+			// RTS can't be used for both.
+			return ErrBadFlowControl
+		}
+		st.c_cflag |= C.CRTSCTS
+	} else {
+		st.c_cflag &= ^C.tcflag_t(C.CRTSCTS)
+	}
+	st.c_iflag &= ^C.tcflag_t(C.IXANY)
+	if c.XONFlowControl {
+		if c.XONChar == c.XOFFChar {
+			return ErrBadFlowControl
+		}
+		st.c_iflag |= C.IXON | C.IXOFF
+		if c.XONAny {
+			st.c_iflag |= C.IXANY
+		}
 	}
+	st.c_cc[C.VSTART] = C.cc_t(c.XONChar)
+	st.c_cc[C.VSTOP] = C.cc_t(c.XOFFChar)
 	// Select raw mode
 	st.c_lflag &= ^C.tcflag_t(C.ICANON | C.ECHO | C.ECHOE | C.ISIG)
 	st.c_oflag &= ^C.tcflag_t(C.OPOST)
 
-	// set blocking / non-blocking read
-	/*
-	*	http://man7.org/linux/man-pages/man3/termios.3.html
-	* - Supports blocking read and read with timeout operations
-	 */
-	vmin, vtime := posixTimeoutValues(readTimeout)
-	st.c_cc[C.VMIN] = C.cc_t(vmin)
-	st.c_cc[C.VTIME] = C.cc_t(vtime)
+	// Return from read as soon as there is data. With the descriptor in
+	// non-blocking mode, an empty read then fails with EAGAIN and waits
+	// in the poller, and ReadTimeout is applied as a deadline.
+	st.c_cc[C.VMIN] = 1
+	st.c_cc[C.VTIME] = 0
 
 	_, err = C.tcsetattr(fd, C.TCSANOW, &st)
 	if err != nil {
-		f.Close()
-		return nil, err
+		return err
 	}
 
-	//fmt.Println("Tweaking", name)
-	r1, _, e := syscall.Syscall(syscall.SYS_FCNTL,
-		uintptr(f.Fd()),
-		uintptr(syscall.F_SETFL),
-		uintptr(0))
-	if e != 0 || r1 != 0 {
-		s := fmt.Sprint("Clearing NONBLOCK syscall error:", e, r1)
-		f.Close()
-		return nil, errors.New(s)
+	// tcsetattr succeeds if any of the changes could be made, so
+	// check that flow control was accepted by the driver.
+	var got C.struct_termios
+	_, err = C.tcgetattr(fd, &got)
+	if err != nil {
+		return err
+	}
+	if got.c_cflag&C.CRTSCTS != st.c_cflag&C.CRTSCTS ||
+		got.c_iflag&(C.IXON|C.IXOFF) != st.c_iflag&(C.IXON|C.IXOFF) {
+		return ErrBadFlowControl
 	}
+	return nil
 
-	/*
-				r1, _, e = syscall.Syscall(syscall.SYS_IOCTL,
-			                uintptr(f.Fd()),
-			                uintptr(0x80045402), // IOSSIOSPEED
-			                uintptr(unsafe.Pointer(&baud)));
-			        if e != 0 || r1 != 0 {
-			                s := fmt.Sprint("Baudrate syscall error:", e, r1)
-					f.Close()
-		                        return nil, os.NewError(s)
-				}
-	*/
+}
 
-	return &Port{f: f}, nil
+// configFromTermios decodes the settings in st into a Config.
+func configFromTermios(st *C.struct_termios) *Config {
+	c := &Config{
+		Parity:   ParityNone,
+		StopBits: Stop1,
+		XONChar:  byte(st.c_cc[C.VSTART]),
+		XOFFChar: byte(st.c_cc[C.VSTOP]),
+	}
+	speed := C.cfgetospeed(st)
+	for baud, s := range bauds {
+		if s == speed {
+			c.Baud = baud
+		}
+	}
+	switch st.c_cflag & C.CSIZE {
+	case C.CS5:
+		c.Size = 5
+	case C.CS6:
+		c.Size = 6
+	case C.CS7:
+		c.Size = 7
+	case C.CS8:
+		c.Size = 8
+	}
+	if st.c_cflag&C.PARENB != 0 {
+		if st.c_cflag&C.PARODD != 0 {
+			c.Parity = ParityOdd
+		} else {
+			c.Parity = ParityEven
+		}
+	}
+	if st.c_cflag&C.CSTOPB != 0 {
+		c.StopBits = Stop2
+	}
+	c.RTSFlowControl = st.c_cflag&C.CRTSCTS != 0
+	c.XONFlowControl = st.c_iflag&(C.IXON|C.IXOFF) != 0
+	c.XONAny = st.c_iflag&C.IXANY != 0
+	c.HangupOnClose = st.c_cflag&C.HUPCL != 0
+	return c
 }
 
 type Port struct {
 	// We intentionly do not use an "embedded" struct so that we
 	// don't export File
-	f *os.File
+	f  *os.File
+	rc syscall.RawConn
+	dl deadlines
+	c  *Config
+
+	lr           *lineErrorReader // set if c.ReportErrors
+	breakHandler func()
+
+	orig    C.struct_termios // settings before openPort
+	lock    *uucpLock        // set if c.Lock
+	sending chan struct{}    // see holdOutput
+	closed  int32            // set by Close; accessed atomically
 }
 
 func (p *Port) Read(b []byte) (n int, err error) {
-	return p.f.Read(b)
+	if p.lr != nil {
+		return p.lr.Read(b)
+	}
+	return p.readFile(b)
 }
 
 func (p *Port) Write(b []byte) (n int, err error) {
-	return p.f.Write(b)
+	// There is no portable RS-485 support in the drivers, so always
+	// switch RTS here.
+	if p.c.RS485 != nil {
+		return p.writeRS485(p.c.RS485, b)
+	}
+	return p.writeFile(b)
+}
+
+// Baud returns the baud rate the port was configured with.
+func (p *Port) Baud() int {
+	return p.c.Baud
+}
+
+// SetConfig changes the settings of the open port to those in c. Output
+// already written is transmitted with the old settings first. c.Name
+// is ignored.
+func (p *Port) SetConfig(c *Config) error {
+	c = c.withDefaults()
+	c.Name = p.c.Name
+	if err := p.drain(context.Background()); err != nil {
+		return err
+	}
+	err := p.control(func(fd uintptr) error {
+		return setTermios(C.int(fd), c)
+	})
+	if err != nil {
+		return err
+	}
+	if c.RS485 != nil {
+		if err := p.SetRTS(c.RS485.RTSAfterSend); err != nil {
+			return err
+		}
+	}
+	p.c = c
+	p.setReportErrors(c.ReportErrors)
+	return nil
+}
+
+// setReportErrors switches between reading the port directly and
+// decoding the line errors marked in the input.
+func (p *Port) setReportErrors(on bool) {
+	if !on {
+		p.lr = nil
+	} else if p.lr == nil {
+		p.lr = &lineErrorReader{r: readerFunc(p.readFile), onBreak: p.onBreak}
+	}
+}
+
+// Config returns the settings currently in effect on the port, as
+// reported by the driver.
+func (p *Port) Config() (*Config, error) {
+	var st C.struct_termios
+	err := p.control(func(fd uintptr) error {
+		_, err := C.tcgetattr(C.int(fd), &st)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := configFromTermios(&st)
+	c.Name = p.c.Name
+	c.ReadTimeout = p.c.ReadTimeout
+	c.InterCharTimeout = p.c.InterCharTimeout
+	c.WriteTimeout = p.c.WriteTimeout
+	return c, nil
 }
 
 // Discards data written to the port but not transmitted,
 // or data received but not read
 func (p *Port) Flush() error {
-	_, err := C.tcflush(C.int(p.f.Fd()), C.TCIOFLUSH)
-	return err
+	p.discardInput()
+	return p.flush(C.TCIOFLUSH)
+}
+
+// FlushInput discards data received but not read.
+func (p *Port) FlushInput() error {
+	p.discardInput()
+	return p.flush(C.TCIFLUSH)
 }
 
+// FlushOutput discards data written to the port but not transmitted.
+func (p *Port) FlushOutput() error {
+	return p.flush(C.TCOFLUSH)
+}
+
+func (p *Port) flush(queue C.int) error {
+	return p.control(func(fd uintptr) error {
+		_, err := C.tcflush(C.int(fd), queue)
+		return err
+	})
+}
+
+// InputWaiting returns the number of bytes received but not read.
+func (p *Port) InputWaiting() (int, error) {
+	n, err := p.queued(C.FIONREAD)
+	return n + p.bufferedInput(), err
+}
+
+// OutputWaiting returns the number of bytes written to the port but not
+// transmitted yet.
+func (p *Port) OutputWaiting() (int, error) {
+	return p.queued(C.TIOCOUTQ)
+}
+
+// SuspendOutput stops transmitting, as if the peer had sent XOFF, until
+// ResumeOutput is called.
+func (p *Port) SuspendOutput() error {
+	return p.flow(C.TCOOFF)
+}
+
+// ResumeOutput restarts output stopped by SuspendOutput.
+func (p *Port) ResumeOutput() error {
+	return p.flow(C.TCOON)
+}
+
+// SuspendInput transmits the XOFF character, asking the peer to stop
+// sending.
+func (p *Port) SuspendInput() error {
+	return p.flow(C.TCIOFF)
+}
+
+// ResumeInput transmits the XON character, asking the peer to resume
+// sending.
+func (p *Port) ResumeInput() error {
+	return p.flow(C.TCION)
+}
+
+// setExclusive makes further opens of the port fail, and flocks it for
+// the benefit of processes running as root, which TIOCEXCL doesn't
+// stop.
+func (p *Port) setExclusive() error {
+	return p.control(func(fd uintptr) error {
+		if _, err := C.ioctl_int(C.int(fd), C.TIOCEXCL, nil); err != nil {
+			return err
+		}
+		_, err := C.flock(C.int(fd), C.LOCK_EX|C.LOCK_NB)
+		if err == syscall.EWOULDBLOCK {
+			return &PortBusyError{Name: p.c.Name}
+		}
+		return err
+	})
+}
+
+// deviceHolder returns the PID of the process holding the device name
+// open exclusively. There is no way to find it here, so it returns 0.
+func deviceHolder(name string) int {
+	return 0
+}
+
+func (p *Port) flow(action C.int) error {
+	return p.control(func(fd uintptr) error {
+		_, err := C.tcflow(C.int(fd), action)
+		return err
+	})
+}
+
+func (p *Port) queued(req C.ulong) (int, error) {
+	var n C.int
+	err := p.control(func(fd uintptr) error {
+		_, err := C.ioctl_int(C.int(fd), req, &n)
+		return err
+	})
+	return int(n), err
+}
+
+// SetDTR raises (on) or lowers the DTR line.
+func (p *Port) SetDTR(on bool) error {
+	return p.setModemLines(C.TIOCM_DTR, on)
+}
+
+// SetRTS raises (on) or lowers the RTS line.
+func (p *Port) SetRTS(on bool) error {
+	return p.setModemLines(C.TIOCM_RTS, on)
+}
+
+// ModemStatus returns the current state of the modem status lines.
+func (p *Port) ModemStatus() (ModemStatus, error) {
+	var bits C.int
+	if err := p.modemIoctl(C.TIOCMGET, &bits); err != nil {
+		return ModemStatus{}, err
+	}
+	return ModemStatus{
+		CTS: bits&C.TIOCM_CTS != 0,
+		DSR: bits&C.TIOCM_DSR != 0,
+		DCD: bits&C.TIOCM_CAR != 0,
+		RI:  bits&C.TIOCM_RNG != 0,
+	}, nil
+}
+
+// modemWatcher waits for changes of the modem lines. It is not
+// supported on this platform.
+type modemWatcher struct{}
+
+func (p *Port) newModemWatcher() (*modemWatcher, error) {
+	return nil, ErrNotSupported
+}
+
+func (w *modemWatcher) wait(ctx context.Context) (ModemEvent, error) {
+	return ModemEvent{}, ErrNotSupported
+}
+
+func (p *Port) setModemLines(bits C.int, on bool) error {
+	var req C.ulong = C.TIOCMBIC
+	if on {
+		req = C.TIOCMBIS
+	}
+	return p.modemIoctl(req, &bits)
+}
+
+// SetBreak starts transmitting a break condition, which lasts until
+// ClearBreak is called.
+func (p *Port) SetBreak() error {
+	return p.control(func(fd uintptr) error {
+		_, err := C.ioctl_int(C.int(fd), C.TIOCSBRK, nil)
+		return err
+	})
+}
+
+// ClearBreak stops transmitting a break condition.
+func (p *Port) ClearBreak() error {
+	return p.control(func(fd uintptr) error {
+		_, err := C.ioctl_int(C.int(fd), C.TIOCCBRK, nil)
+		return err
+	})
+}
+
+// waitSent waits for the last characters, which have left the output
+// queue but may still be in the UART, to be transmitted.
+func (p *Port) waitSent() error {
+	return p.control(func(fd uintptr) error {
+		_, err := C.tcdrain(C.int(fd))
+		return err
+	})
+}
+
+// restoreTermios restores the settings the port had before it was
+// opened. HUPCL is left as HangupOnClose says, since the original
+// settings usually have it set and would hang up the line on Close.
+func (p *Port) restoreTermios() error {
+	st := p.orig
+	st.c_cflag &= ^C.tcflag_t(C.HUPCL)
+	if p.c.HangupOnClose {
+		st.c_cflag |= C.HUPCL
+	}
+	return p.control(func(fd uintptr) error {
+		_, err := C.tcsetattr(C.int(fd), C.TCSANOW, &st)
+		return err
+	})
+}
+
+// Close closes the port. Reads and Writes blocked on the port return
+// ErrClosed.
 func (p *Port) Close() (err error) {
-	return p.f.Close()
+	return p.closeFile()
+}
+
+// modemIoctl issues an ioctl taking an int argument, reporting the
+// errors returned by drivers without modem control lines, such as ptys,
+// as ErrNotSupported.
+func (p *Port) modemIoctl(req C.ulong, arg *C.int) error {
+	return p.control(func(fd uintptr) error {
+		_, err := C.ioctl_int(C.int(fd), req, arg)
+		if err == syscall.ENOTTY || err == syscall.EINVAL {
+			return ErrNotSupported
+		}
+		return err
+	})
 }
@@ -0,0 +1,86 @@
+package serial
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+// chunkReader returns at most one chunk per Read, then io.EOF.
+type chunkReader [][]byte
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, (*r)[0])
+	(*r)[0] = (*r)[0][n:]
+	if len((*r)[0]) == 0 {
+		*r = (*r)[1:]
+	}
+	return n, nil
+}
+
+func TestLineErrorReader(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     [][]byte
+		want   string // data read, with line errors shown in brackets
+		breaks int
+	}{
+		{"plain", [][]byte{[]byte("hello")}, "hello", 0},
+		{"escaped 0377", [][]byte{{'a', 0377, 0377, 'b'}}, "a\377b", 0},
+		{"break", [][]byte{{'a', 0377, 0, 0, 'b'}}, "a[break]b", 1},
+		{"parity", [][]byte{{0377, 0, 'x', 'b'}}, "[x]b", 0},
+		{"split mark", [][]byte{{'a', 0377}, {0}, {0, 'b'}}, "a[break]b", 1},
+		{"split escape", [][]byte{{'a', 0377}, {0377, 'b'}}, "a\377b", 0},
+		{"long", [][]byte{[]byte("0123456789"), {0377, 0, 0}}, "0123456789[break]", 1},
+	}
+	for _, tt := range tests {
+		breaks := 0
+		r := &lineErrorReader{r: (*chunkReader)(&tt.in), onBreak: func() { breaks++ }}
+		got := ""
+		buf := make([]byte, 3)
+		for {
+			n, err := r.Read(buf)
+			got += string(buf[:n])
+			if err == io.EOF {
+				break
+			}
+			if lerr, ok := err.(*LineError); ok {
+				if lerr.Break {
+					got += "[break]"
+				} else {
+					got += fmt.Sprintf("[%c]", lerr.Char)
+				}
+			} else if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s: read %q, want %q", tt.name, got, tt.want)
+		}
+		if breaks != tt.breaks {
+			t.Errorf("%s: break handler called %d times, want %d", tt.name, breaks, tt.breaks)
+		}
+	}
+}
+
+func TestCharTime(t *testing.T) {
+	tests := []struct {
+		c    Config
+		want time.Duration
+	}{
+		{Config{Baud: 9600, Size: 8, Parity: ParityNone, StopBits: Stop1}, time.Second / 960},
+		{Config{Baud: 9600, Size: 8, Parity: ParityEven, StopBits: Stop1}, 11 * time.Second / 9600},
+		{Config{Baud: 1000, Size: 5, Parity: ParityNone, StopBits: Stop1Half}, 7500 * time.Microsecond},
+		{Config{Baud: 1000, Size: 7, Parity: ParityOdd, StopBits: Stop2}, 11 * time.Millisecond},
+		{Config{Size: 8}, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.c.charTime(); got != tt.want {
+			t.Errorf("%+v: charTime() = %v, want %v", tt.c, got, tt.want)
+		}
+	}
+}
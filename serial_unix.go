@@ -0,0 +1,290 @@
+// +build !windows
+
+package serial
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The Linux and POSIX ports keep their file descriptor in non-blocking
+// mode, so that Read and Write go through the runtime poller and can be
+// interrupted by deadlines. The descriptor is only used through control,
+// since os.File.Fd would switch it back to blocking mode.
+
+// deadlines holds the deadlines of a Port.
+type deadlines struct {
+	mu           sync.Mutex
+	read, write  time.Time // set with SetReadDeadline and SetWriteDeadline
+	readTimeout  time.Time // end of Config.ReadTimeout for the current Read
+	writeTimeout time.Time // end of Config.WriteTimeout for the current Write
+
+	// frameGap overrides Config.InterCharTimeout during ReadFrame.
+	frameGap time.Duration
+}
+
+// SetDeadline sets both the read and write deadlines of the port.
+func (p *Port) SetDeadline(t time.Time) error {
+	if err := p.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the time after which pending and future calls to
+// Read fail with os.ErrDeadlineExceeded. A zero t means no deadline;
+// Config.ReadTimeout still applies to each Read.
+func (p *Port) SetReadDeadline(t time.Time) error {
+	p.dl.mu.Lock()
+	defer p.dl.mu.Unlock()
+	p.dl.read = t
+	return p.closedError(p.f.SetReadDeadline(earliest(t, p.dl.readTimeout)))
+}
+
+// SetWriteDeadline sets the time after which pending and future calls
+// to Write fail with os.ErrDeadlineExceeded, returning the number of
+// bytes written so far. A zero t means no deadline; Config.WriteTimeout
+// still applies to each Write.
+func (p *Port) SetWriteDeadline(t time.Time) error {
+	p.dl.mu.Lock()
+	defer p.dl.mu.Unlock()
+	p.dl.write = t
+	return p.closedError(p.f.SetWriteDeadline(earliest(t, p.dl.writeTimeout)))
+}
+
+// readFile reads from the port's file, applying Config.ReadTimeout and
+// the inter-character timeout.
+func (p *Port) readFile(b []byte) (int, error) {
+	var total time.Time
+	if p.c.ReadTimeout > 0 {
+		total = time.Now().Add(p.c.ReadTimeout)
+	}
+	n, err := p.readUntil(b, total)
+	if errors.Is(err, os.ErrDeadlineExceeded) && !total.IsZero() && !time.Now().Before(total) {
+		return n, ErrTimeout
+	}
+	if err != nil {
+		return n, err
+	}
+
+	p.dl.mu.Lock()
+	gap := p.dl.frameGap
+	p.dl.mu.Unlock()
+	if gap <= 0 {
+		gap = p.c.InterCharTimeout
+	}
+	if gap <= 0 {
+		return n, nil
+	}
+	// Keep reading until the line goes quiet, as VTIME does with a
+	// positive VMIN.
+	for n < len(b) {
+		timeout := earliest(total, time.Now().Add(gap))
+		m, err := p.readUntil(b[n:], timeout)
+		n += m
+		if errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(timeout) {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readUntil reads from the port's file, giving up at timeout as well as
+// at the read deadline.
+func (p *Port) readUntil(b []byte, timeout time.Time) (int, error) {
+	p.dl.mu.Lock()
+	p.dl.readTimeout = timeout
+	err := p.f.SetReadDeadline(earliest(p.dl.read, timeout))
+	p.dl.mu.Unlock()
+	if err != nil {
+		return 0, p.closedError(err)
+	}
+	n, err := p.f.Read(b)
+	if err == io.EOF {
+		// With VMIN=1, a tty only reads nothing once it hung up.
+		return n, ErrDisconnected
+	}
+	return n, disconnectedError(p.closedError(err))
+}
+
+// readFrame reads like Read, with an inter-character timeout of gap.
+func (p *Port) readFrame(b []byte, gap time.Duration) (int, error) {
+	p.dl.mu.Lock()
+	p.dl.frameGap = gap
+	p.dl.mu.Unlock()
+	defer func() {
+		p.dl.mu.Lock()
+		p.dl.frameGap = 0
+		p.dl.mu.Unlock()
+	}()
+	return p.Read(b)
+}
+
+// writeFile writes to the port's file, applying Config.WriteTimeout.
+func (p *Port) writeFile(b []byte) (int, error) {
+	p.dl.mu.Lock()
+	p.dl.writeTimeout = time.Time{}
+	if p.c.WriteTimeout > 0 {
+		p.dl.writeTimeout = time.Now().Add(p.c.WriteTimeout)
+	}
+	timeout := p.dl.writeTimeout
+	deadline := earliest(p.dl.write, timeout)
+	err := p.f.SetWriteDeadline(deadline)
+	p.dl.mu.Unlock()
+	if err != nil {
+		return 0, p.closedError(err)
+	}
+
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	// Wait for a drain in progress, within the deadline.
+	var n int
+	release, err := p.holdOutput(ctx)
+	if err == nil {
+		n, err = p.f.Write(b)
+		release()
+	} else {
+		err = os.ErrDeadlineExceeded
+	}
+	if errors.Is(err, os.ErrDeadlineExceeded) && !timeout.IsZero() && !time.Now().Before(timeout) {
+		return n, ErrTimeout
+	}
+	return n, disconnectedError(p.closedError(err))
+}
+
+// holdOutput waits until no Write or drain is in progress, and keeps
+// others from starting until release is called. Draining holds off
+// Writes, so that the output queue stays empty once it has been
+// emptied. It gives up when ctx is done.
+func (p *Port) holdOutput(ctx context.Context) (release func(), err error) {
+	select {
+	case p.sending <- struct{}{}:
+		return func() { <-p.sending }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// writeRS485 sets RTS around writing b, for drivers without RS-485
+// support.
+func (p *Port) writeRS485(rc *RS485Config, b []byte) (int, error) {
+	if err := p.SetRTS(rc.RTSOnSend); err != nil {
+		return 0, err
+	}
+	time.Sleep(rc.DelayBeforeSend)
+	n, err := p.writeFile(b)
+	if derr := p.drain(context.Background()); err == nil {
+		err = derr
+	}
+	time.Sleep(rc.DelayAfterSend)
+	if rerr := p.SetRTS(rc.RTSAfterSend); err == nil {
+		err = rerr
+	}
+	return n, err
+}
+
+// restoreDrainTimeout is how long closeFile waits for stalled output
+// before restoring the original settings, on top of the time the
+// queued output takes to transmit.
+const restoreDrainTimeout = 500 * time.Millisecond
+
+// closeFile closes the port's file. Pending Reads and Writes return
+// ErrClosed.
+func (p *Port) closeFile() error {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return ErrClosed
+	}
+	var err error
+	if p.c.RestoreOnClose {
+		// Output held up by flow control must not hang Close, so
+		// waiting for it is bounded.
+		n, _ := p.OutputWaiting()
+		timeout := restoreDrainTimeout + time.Duration(n)*p.c.charTime()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		p.waitOutput(ctx)
+		cancel()
+		err = p.restoreTermios()
+	}
+	if cerr := p.f.Close(); err == nil {
+		err = cerr
+	}
+	if p.lock != nil {
+		if uerr := p.lock.unlock(); err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// closedError reports err as ErrClosed once the port is closed, in place
+// of the various errors os.File and its RawConn return.
+func (p *Port) closedError(err error) error {
+	if err != nil && atomic.LoadInt32(&p.closed) != 0 {
+		return ErrClosed
+	}
+	return err
+}
+
+// discardInput drops input that Read has buffered for decoding line
+// errors.
+func (p *Port) discardInput() {
+	if p.lr != nil {
+		p.lr.buf = nil
+	}
+}
+
+// bufferedInput returns the number of bytes of input that Read has
+// buffered for decoding line errors.
+func (p *Port) bufferedInput() int {
+	if p.lr != nil {
+		return len(p.lr.buf)
+	}
+	return 0
+}
+
+// disconnectedError reports the errors a tty returns once the device
+// is gone as ErrDisconnected.
+func disconnectedError(err error) error {
+	if errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENXIO) || errors.Is(err, syscall.ENODEV) {
+		return ErrDisconnected
+	}
+	return err
+}
+
+// readerFunc turns a read function into an io.Reader.
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(b []byte) (int, error) {
+	return f(b)
+}
+
+// control calls fn with the port's file descriptor. fn must not block,
+// as Close waits for it to return.
+func (p *Port) control(fn func(fd uintptr) error) error {
+	var ferr error
+	if err := p.rc.Control(func(fd uintptr) { ferr = fn(fd) }); err != nil {
+		return p.closedError(err)
+	}
+	return ferr
+}
+
+// earliest returns the earlier of two deadlines, where zero means none.
+func earliest(a, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
@@ -3,6 +3,7 @@
 package serial
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sync"
@@ -16,8 +17,37 @@ type Port struct {
 	fd syscall.Handle
 	rl sync.Mutex
 	wl sync.Mutex
+	el sync.Mutex
 	ro *syscall.Overlapped
 	wo *syscall.Overlapped
+	eo *syscall.Overlapped
+	c  *Config
+
+	orig structDCB // settings before openPort
+
+	// Deadlines for Read and Write. The wake events are signalled
+	// when they change, to reevaluate a pending operation. dlmu also
+	// guards the event handles, which Close closes and zeroes.
+	dlmu         sync.Mutex
+	rdl, wdl     time.Time
+	rwake, wwake syscall.Handle
+
+	// closing is signalled, and stays signalled, once Close is called.
+	// closed is set under rl, wl and el when the handle is closed.
+	closing syscall.Handle
+	closed  bool
+
+	lerr         *LineError // line error to return from the next Read
+	breakHandler func()
+
+	// cerrs holds the line errors that ClearCommError reported outside
+	// of Read, for Read to return.
+	cerrmu sync.Mutex
+	cerrs  uint32
+
+	// emask receives the events of an overlapped WaitCommEvent, so it
+	// must not live on a (movable) goroutine stack.
+	emask uint32
 }
 
 type structDCB struct {
@@ -29,6 +59,12 @@ type structDCB struct {
 	wReserved1                                     uint16
 }
 
+type structComstat struct {
+	flags    uint32
+	cbInQue  uint32
+	cbOutQue uint32
+}
+
 type structTimeouts struct {
 	ReadIntervalTimeout         uint32
 	ReadTotalTimeoutMultiplier  uint32
@@ -37,7 +73,11 @@ type structTimeouts struct {
 	WriteTotalTimeoutConstant   uint32
 }
 
-func openPort(name string, baud int, databits byte, parity Parity, stopbits StopBits, readTimeout time.Duration) (p *Port, err error) {
+func openPort(c *Config) (p *Port, err error) {
+	if c.Lock {
+		return nil, ErrNotSupported
+	}
+	name := c.Name
 	if len(name) > 0 && name[0] != '\\' {
 		name = "\\\\.\\" + name
 	}
@@ -49,6 +89,10 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 		syscall.OPEN_EXISTING,
 		syscall.FILE_ATTRIBUTE_NORMAL|syscall.FILE_FLAG_OVERLAPPED,
 		0)
+	if err == syscall.ERROR_ACCESS_DENIED {
+		// Ports are opened without sharing, so someone else has it.
+		return nil, &PortBusyError{Name: c.Name}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -59,53 +103,132 @@ func openPort(name string, baud int, databits byte, parity Parity, stopbits Stop
 		}
 	}()
 
-	if err = setCommState(h, baud, databits, parity, stopbits); err != nil {
+	var orig structDCB
+	if err = getCommState(h, &orig); err != nil {
+		return nil, err
+	}
+	// Start from a clean DCB, with DTR raised and RTS lowered.
+	var dcb structDCB
+	dcb.flags[0] = 0x10 // fDtrControl = DTR_CONTROL_ENABLE
+	if err = setCommState(h, &dcb, c); err != nil {
 		return nil, err
 	}
 	if err = setupComm(h, 64, 64); err != nil {
 		return nil, err
 	}
-	if err = setCommTimeouts(h, readTimeout); err != nil {
+	if err = setCommTimeouts(h, c); err != nil {
 		return nil, err
 	}
 	if err = setCommMask(h); err != nil {
 		return nil, err
 	}
 
-	ro, err := newOverlapped()
-	if err != nil {
-		return nil, err
-	}
-	wo, err := newOverlapped()
-	if err != nil {
-		return nil, err
-	}
 	port := new(Port)
 	port.f = f
 	port.fd = h
-	port.ro = ro
-	port.wo = wo
+	port.c = c
+	port.orig = orig
+	defer func() {
+		if err != nil {
+			port.closeEvents()
+		}
+	}()
 
+	if port.ro, err = newOverlapped(); err != nil {
+		return nil, err
+	}
+	if port.wo, err = newOverlapped(); err != nil {
+		return nil, err
+	}
+	if port.eo, err = newOverlapped(); err != nil {
+		return nil, err
+	}
+	if port.rwake, err = newEvent(false); err != nil {
+		return nil, err
+	}
+	if port.wwake, err = newEvent(false); err != nil {
+		return nil, err
+	}
+	if port.closing, err = newEvent(true); err != nil {
+		return nil, err
+	}
 	return port, nil
 }
 
+// closeEvents closes the event handles of the port that were created.
+func (p *Port) closeEvents() {
+	p.dlmu.Lock()
+	defer p.dlmu.Unlock()
+	for _, o := range []*syscall.Overlapped{p.ro, p.wo, p.eo} {
+		if o != nil && o.HEvent != 0 {
+			syscall.CloseHandle(o.HEvent)
+			o.HEvent = 0
+		}
+	}
+	for _, h := range []*syscall.Handle{&p.rwake, &p.wwake, &p.closing} {
+		if *h != 0 {
+			syscall.CloseHandle(*h)
+			*h = 0
+		}
+	}
+}
+
+// Close closes the port. Reads and Writes blocked on the port return
+// ErrClosed.
 func (p *Port) Close() error {
-	return p.f.Close()
+	// Wake pending operations first; they hold the locks below.
+	p.dlmu.Lock()
+	if p.closing == 0 {
+		p.dlmu.Unlock()
+		return ErrClosed
+	}
+	err := setEvent(p.closing)
+	p.dlmu.Unlock()
+	if err != nil {
+		return err
+	}
+	p.rl.Lock()
+	defer p.rl.Unlock()
+	p.wl.Lock()
+	defer p.wl.Unlock()
+	p.el.Lock()
+	defer p.el.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	p.closed = true
+	if p.c.RestoreOnClose {
+		err = setCommStateDCB(p.fd, &p.orig)
+	}
+	if cerr := p.f.Close(); err == nil {
+		err = cerr
+	}
+	p.closeEvents()
+	return err
 }
 
 func (p *Port) Write(buf []byte) (int, error) {
 	p.wl.Lock()
 	defer p.wl.Unlock()
 
+	if p.closed {
+		return 0, ErrClosed
+	}
 	if err := resetEvent(p.wo.HEvent); err != nil {
 		return 0, err
 	}
 	var n uint32
 	err := syscall.WriteFile(p.fd, buf, &n, p.wo)
 	if err != nil && err != syscall.ERROR_IO_PENDING {
-		return int(n), err
+		return int(n), disconnectedError(err)
 	}
-	return getOverlappedResult(p.fd, p.wo)
+	m, err := p.wait(p.wo, p.wwake, &p.wdl)
+	if err == nil && m < len(buf) {
+		// WriteTotalTimeoutConstant ran out.
+		err = ErrTimeout
+	}
+	return m, disconnectedError(err)
 }
 
 func (p *Port) Read(buf []byte) (int, error) {
@@ -116,32 +239,509 @@ func (p *Port) Read(buf []byte) (int, error) {
 	p.rl.Lock()
 	defer p.rl.Unlock()
 
+	if p.closed {
+		return 0, ErrClosed
+	}
+	if p.lerr != nil {
+		err := p.lerr
+		p.lerr = nil
+		return 0, err
+	}
+
 	if err := resetEvent(p.ro.HEvent); err != nil {
 		return 0, err
 	}
 	var done uint32
 	err := syscall.ReadFile(p.fd, buf, &done, p.ro)
 	if err != nil && err != syscall.ERROR_IO_PENDING {
-		return int(done), err
+		return int(done), disconnectedError(err)
+	}
+	n, err := p.wait(p.ro, p.rwake, &p.rdl)
+	if err != nil {
+		return n, disconnectedError(err)
+	}
+	if n == 0 && len(buf) > 0 {
+		err = ErrTimeout
+	}
+	if !p.c.ReportErrors {
+		return n, err
+	}
+
+	// Windows only reports line errors for the port as a whole, so the
+	// best we can do is to place them after the bytes just read.
+	errs, _, cerr := clearCommError(p.fd)
+	if cerr != nil {
+		return n, disconnectedError(cerr)
+	}
+	p.cerrmu.Lock()
+	errs |= p.cerrs
+	p.cerrs = 0
+	p.cerrmu.Unlock()
+	const CE_RXPARITY = 0x0004
+	const CE_FRAME = 0x0008
+	const CE_BREAK = 0x0010
+	var lerr *LineError
+	switch {
+	case errs&CE_BREAK != 0:
+		lerr = &LineError{Break: true}
+		p.onBreak()
+	case errs&(CE_FRAME|CE_RXPARITY) != 0:
+		lerr = &LineError{}
+	default:
+		return n, err
+	}
+	if n > 0 {
+		p.lerr = lerr
+		return n, nil
+	}
+	return 0, lerr
+}
+
+// readFrame reads like Read, with an inter-character timeout of gap.
+func (p *Port) readFrame(b []byte, gap time.Duration) (n int, err error) {
+	c := *p.c
+	c.InterCharTimeout = gap
+	if err := setCommTimeouts(p.fd, &c); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if rerr := setCommTimeouts(p.fd, p.c); err == nil {
+			err = rerr
+		}
+	}()
+	return p.Read(b)
+}
+
+// SetDeadline sets both the read and write deadlines of the port.
+func (p *Port) SetDeadline(t time.Time) error {
+	if err := p.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return p.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the time after which pending and future calls to
+// Read fail with os.ErrDeadlineExceeded. A zero t means no deadline;
+// Config.ReadTimeout still applies to each Read.
+func (p *Port) SetReadDeadline(t time.Time) error {
+	p.dlmu.Lock()
+	defer p.dlmu.Unlock()
+	if p.rwake == 0 {
+		return ErrClosed
+	}
+	p.rdl = t
+	return setEvent(p.rwake)
+}
+
+// SetWriteDeadline sets the time after which pending and future calls
+// to Write fail with os.ErrDeadlineExceeded, returning the number of
+// bytes written so far. A zero t means no deadline.
+func (p *Port) SetWriteDeadline(t time.Time) error {
+	p.dlmu.Lock()
+	defer p.dlmu.Unlock()
+	if p.wwake == 0 {
+		return ErrClosed
+	}
+	p.wdl = t
+	return setEvent(p.wwake)
+}
+
+// wait waits for the overlapped operation o to complete, and cancels it
+// when the port is closed or the deadline *dl passes. wake is signalled
+// when *dl changes. A nil dl means no deadline.
+func (p *Port) wait(o *syscall.Overlapped, wake syscall.Handle, dl *time.Time) (int, error) {
+	const WAIT_OBJECT_0 = 0
+	const WAIT_TIMEOUT = 0x102
+	handles := []syscall.Handle{o.HEvent, p.closing}
+	if wake != 0 {
+		handles = append(handles, wake)
+	}
+	for {
+		var deadline time.Time
+		if dl != nil {
+			p.dlmu.Lock()
+			deadline = *dl
+			p.dlmu.Unlock()
+		}
+
+		timeout := uint32(syscall.INFINITE)
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				syscall.CancelIoEx(p.fd, o)
+				n, err := getOverlappedResult(p.fd, o)
+				if err == syscall.ERROR_OPERATION_ABORTED {
+					err = os.ErrDeadlineExceeded
+				}
+				return n, err
+			}
+			if ms := (left + time.Millisecond - 1) / time.Millisecond; ms < syscall.INFINITE {
+				timeout = uint32(ms)
+			}
+		}
+
+		r, _, err := syscall.Syscall6(nWaitForMultipleObjects, 4,
+			uintptr(len(handles)), uintptr(unsafe.Pointer(&handles[0])), 0, uintptr(timeout), 0, 0)
+		switch r {
+		case WAIT_OBJECT_0:
+			return getOverlappedResult(p.fd, o)
+		case WAIT_OBJECT_0 + 1:
+			syscall.CancelIoEx(p.fd, o)
+			n, err := getOverlappedResult(p.fd, o)
+			if err == syscall.ERROR_OPERATION_ABORTED {
+				err = ErrClosed
+			}
+			return n, err
+		case WAIT_OBJECT_0 + 2, WAIT_TIMEOUT:
+			// The deadline changed or passed; check it again.
+		default:
+			syscall.CancelIoEx(p.fd, o)
+			getOverlappedResult(p.fd, o)
+			return 0, err
+		}
+	}
+}
+
+// Baud returns the baud rate the port was configured with.
+func (p *Port) Baud() int {
+	return p.c.Baud
+}
+
+// SetConfig changes the settings of the open port to those in c. Output
+// already written is transmitted with the old settings first. c.Name
+// is ignored.
+func (p *Port) SetConfig(c *Config) error {
+	c = c.withDefaults()
+	c.Name = p.c.Name
+	if err := p.drain(context.Background()); err != nil {
+		return err
+	}
+	// Keep the settings Config doesn't cover, such as the DTR and RTS
+	// lines.
+	var dcb structDCB
+	if err := getCommState(p.fd, &dcb); err != nil {
+		return err
+	}
+	if err := setCommState(p.fd, &dcb, c); err != nil {
+		return err
 	}
-	return getOverlappedResult(p.fd, p.ro)
+	if err := setCommTimeouts(p.fd, c); err != nil {
+		return err
+	}
+	p.c = c
+	return nil
+}
+
+// Config returns the settings currently in effect on the port, as
+// reported by the driver.
+func (p *Port) Config() (*Config, error) {
+	var params structDCB
+	if err := getCommState(p.fd, &params); err != nil {
+		return nil, err
+	}
+	var timeouts structTimeouts
+	r, _, err := syscall.Syscall(nGetCommTimeouts, 2, uintptr(p.fd), uintptr(unsafe.Pointer(&timeouts)), 0)
+	if r == 0 {
+		return nil, err
+	}
+
+	c := &Config{
+		Name:     p.c.Name,
+		Baud:     int(params.BaudRate),
+		Size:     params.ByteSize,
+		XONChar:  params.XonChar,
+		XOFFChar: params.XoffChar,
+	}
+	switch params.Parity {
+	case 0:
+		c.Parity = ParityNone
+	case 1:
+		c.Parity = ParityOdd
+	case 2:
+		c.Parity = ParityEven
+	case 3:
+		c.Parity = ParityMark
+	case 4:
+		c.Parity = ParitySpace
+	}
+	switch params.StopBits {
+	case 0:
+		c.StopBits = Stop1
+	case 1:
+		c.StopBits = Stop1Half
+	case 2:
+		c.StopBits = Stop2
+	}
+	c.RTSFlowControl = params.flags[0]&0x04 != 0 // fOutxCtsFlow
+	c.XONFlowControl = params.flags[1]&0x03 != 0 // fOutX, fInX
+
+	c.WriteTimeout = time.Duration(timeouts.WriteTotalTimeoutConstant) * time.Millisecond
+	if timeouts.ReadIntervalTimeout != 0 && timeouts.ReadIntervalTimeout != 1<<32-1 {
+		c.InterCharTimeout = time.Duration(timeouts.ReadIntervalTimeout) * time.Millisecond
+		c.ReadTimeout = time.Duration(timeouts.ReadTotalTimeoutConstant) * time.Millisecond
+	} else if timeouts.ReadTotalTimeoutConstant < 1<<32-2 {
+		// A constant of MAXDWORD-1 is what setCommTimeouts uses for
+		// blocking reads.
+		c.ReadTimeout = time.Duration(timeouts.ReadTotalTimeoutConstant) * time.Millisecond
+	}
+	return c, nil
 }
 
 // Discards data written to the port but not transmitted,
 // or data received but not read
 func (p *Port) Flush() error {
-	return purgeComm(p.fd)
+	const PURGE_TXABORT = 0x0001
+	const PURGE_RXABORT = 0x0002
+	const PURGE_TXCLEAR = 0x0004
+	const PURGE_RXCLEAR = 0x0008
+	return purgeComm(p.fd, PURGE_TXABORT|PURGE_RXABORT|PURGE_TXCLEAR|PURGE_RXCLEAR)
+}
+
+// FlushInput discards data received but not read.
+func (p *Port) FlushInput() error {
+	const PURGE_RXCLEAR = 0x0008
+	return purgeComm(p.fd, PURGE_RXCLEAR)
+}
+
+// FlushOutput discards data written to the port but not transmitted.
+func (p *Port) FlushOutput() error {
+	const PURGE_TXCLEAR = 0x0004
+	return purgeComm(p.fd, PURGE_TXCLEAR)
+}
+
+// InputWaiting returns the number of bytes received but not read.
+func (p *Port) InputWaiting() (int, error) {
+	stat, err := p.commStatus()
+	if err != nil {
+		return 0, err
+	}
+	return int(stat.cbInQue), nil
+}
+
+// OutputWaiting returns the number of bytes written to the port but not
+// transmitted yet.
+func (p *Port) OutputWaiting() (int, error) {
+	stat, err := p.commStatus()
+	if err != nil {
+		return 0, err
+	}
+	return int(stat.cbOutQue), nil
+}
+
+// SuspendOutput stops transmitting, as if the peer had sent XOFF, until
+// ResumeOutput is called.
+func (p *Port) SuspendOutput() error {
+	const SETXOFF = 1
+	return escapeCommFunction(p.fd, SETXOFF)
+}
+
+// ResumeOutput restarts output stopped by SuspendOutput.
+func (p *Port) ResumeOutput() error {
+	const SETXON = 2
+	return escapeCommFunction(p.fd, SETXON)
+}
+
+// SuspendInput transmits the XOFF character, asking the peer to stop
+// sending.
+func (p *Port) SuspendInput() error {
+	return transmitCommChar(p.fd, p.c.XOFFChar)
+}
+
+// ResumeInput transmits the XON character, asking the peer to resume
+// sending.
+func (p *Port) ResumeInput() error {
+	return transmitCommChar(p.fd, p.c.XONChar)
+}
+
+// commStatus calls ClearCommError, keeping the line errors it clears
+// for Read.
+func (p *Port) commStatus() (*structComstat, error) {
+	errs, stat, err := clearCommError(p.fd)
+	if err != nil {
+		return nil, err
+	}
+	p.cerrmu.Lock()
+	p.cerrs |= errs
+	p.cerrmu.Unlock()
+	return stat, nil
+}
+
+// SetDTR raises (on) or lowers the DTR line.
+func (p *Port) SetDTR(on bool) error {
+	const SETDTR = 5
+	const CLRDTR = 6
+	if on {
+		return escapeCommFunction(p.fd, SETDTR)
+	}
+	return escapeCommFunction(p.fd, CLRDTR)
+}
+
+// SetRTS raises (on) or lowers the RTS line.
+func (p *Port) SetRTS(on bool) error {
+	const SETRTS = 3
+	const CLRRTS = 4
+	if on {
+		return escapeCommFunction(p.fd, SETRTS)
+	}
+	return escapeCommFunction(p.fd, CLRRTS)
+}
+
+// ModemStatus returns the current state of the modem status lines.
+func (p *Port) ModemStatus() (ModemStatus, error) {
+	const MS_CTS_ON = 0x0010
+	const MS_DSR_ON = 0x0020
+	const MS_RING_ON = 0x0040
+	const MS_RLSD_ON = 0x0080
+	var bits uint32
+	r, _, err := syscall.Syscall(nGetCommModemStatus, 2, uintptr(p.fd), uintptr(unsafe.Pointer(&bits)), 0)
+	if r == 0 {
+		return ModemStatus{}, err
+	}
+	return ModemStatus{
+		CTS: bits&MS_CTS_ON != 0,
+		DSR: bits&MS_DSR_ON != 0,
+		DCD: bits&MS_RLSD_ON != 0,
+		RI:  bits&MS_RING_ON != 0,
+	}, nil
+}
+
+// modemWatcher waits for changes of the modem lines. The driver keeps
+// the events that happen between two waits for the next one.
+type modemWatcher struct {
+	p *Port
+}
+
+func (p *Port) newModemWatcher() (*modemWatcher, error) {
+	// Fail early if the port has no modem status lines at all.
+	if _, err := p.ModemStatus(); err != nil {
+		return nil, err
+	}
+	return &modemWatcher{p}, nil
+}
+
+func (w *modemWatcher) wait(ctx context.Context) (ModemEvent, error) {
+	return w.p.waitModemChange(ctx)
+}
+
+// waitModemChange returns the next change of the lines, or ctx.Err()
+// if ctx is done first.
+func (p *Port) waitModemChange(ctx context.Context) (ModemEvent, error) {
+	p.el.Lock()
+	defer p.el.Unlock()
+
+	if p.closed {
+		return ModemEvent{}, ErrClosed
+	}
+	for {
+		if err := resetEvent(p.eo.HEvent); err != nil {
+			return ModemEvent{}, err
+		}
+		p.emask = 0
+		r, _, e := syscall.Syscall(nWaitCommEvent, 3, uintptr(p.fd),
+			uintptr(unsafe.Pointer(&p.emask)), uintptr(unsafe.Pointer(p.eo)))
+		if r == 0 && e != syscall.ERROR_IO_PENDING {
+			return ModemEvent{}, e
+		}
+		if _, err := p.waitEvent(ctx); err != nil {
+			return ModemEvent{}, err
+		}
+		if p.emask&modemEvents == 0 {
+			continue
+		}
+
+		status, err := p.ModemStatus()
+		if err != nil {
+			return ModemEvent{}, err
+		}
+		return ModemEvent{
+			Time:   time.Now(),
+			Status: status,
+			Changed: ModemStatus{
+				CTS: p.emask&EV_CTS != 0,
+				DSR: p.emask&EV_DSR != 0,
+				DCD: p.emask&EV_RLSD != 0,
+				RI:  p.emask&EV_RING != 0,
+			},
+		}, nil
+	}
+}
+
+// waitEvent waits for the pending WaitCommEvent, cancelling it when
+// ctx is done.
+func (p *Port) waitEvent(ctx context.Context) (int, error) {
+	if ctx.Done() == nil {
+		return p.wait(p.eo, 0, nil)
+	}
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			syscall.CancelIoEx(p.fd, p.eo)
+		case <-done:
+		}
+	}()
+	n, err := p.wait(p.eo, 0, nil)
+	close(done)
+	<-exited
+	if err == syscall.ERROR_OPERATION_ABORTED && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return n, err
+}
+
+// SetBreak starts transmitting a break condition, which lasts until
+// ClearBreak is called.
+func (p *Port) SetBreak() error {
+	r, _, err := syscall.Syscall(nSetCommBreak, 1, uintptr(p.fd), 0, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// ClearBreak stops transmitting a break condition.
+func (p *Port) ClearBreak() error {
+	r, _, err := syscall.Syscall(nClearCommBreak, 1, uintptr(p.fd), 0, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// holdOutput does nothing on Windows, where Write holds wl for as long
+// as it blocks, and a drain must not wait for that without limit.
+func (p *Port) holdOutput(ctx context.Context) (release func(), err error) {
+	return func() {}, nil
+}
+
+// waitSent waits for the last characters, which have left the output
+// queue but may still be in the UART, to be transmitted.
+func (p *Port) waitSent() error {
+	return flushFileBuffers(p.fd)
 }
 
 var (
 	nSetCommState,
+	nGetCommState,
+	nGetCommTimeouts,
 	nSetCommTimeouts,
 	nSetCommMask,
 	nSetupComm,
 	nGetOverlappedResult,
 	nCreateEvent,
 	nResetEvent,
+	nSetEvent,
+	nWaitForMultipleObjects,
 	nPurgeComm,
+	nEscapeCommFunction,
+	nGetCommModemStatus,
+	nWaitCommEvent,
+	nClearCommError,
+	nSetCommBreak,
+	nTransmitCommChar,
+	nClearCommBreak,
 	nFlushFileBuffers uintptr
 )
 
@@ -153,13 +753,24 @@ func init() {
 	defer syscall.FreeLibrary(k32)
 
 	nSetCommState = getProcAddr(k32, "SetCommState")
+	nGetCommState = getProcAddr(k32, "GetCommState")
+	nGetCommTimeouts = getProcAddr(k32, "GetCommTimeouts")
 	nSetCommTimeouts = getProcAddr(k32, "SetCommTimeouts")
 	nSetCommMask = getProcAddr(k32, "SetCommMask")
 	nSetupComm = getProcAddr(k32, "SetupComm")
 	nGetOverlappedResult = getProcAddr(k32, "GetOverlappedResult")
 	nCreateEvent = getProcAddr(k32, "CreateEventW")
 	nResetEvent = getProcAddr(k32, "ResetEvent")
+	nSetEvent = getProcAddr(k32, "SetEvent")
+	nWaitForMultipleObjects = getProcAddr(k32, "WaitForMultipleObjects")
 	nPurgeComm = getProcAddr(k32, "PurgeComm")
+	nEscapeCommFunction = getProcAddr(k32, "EscapeCommFunction")
+	nGetCommModemStatus = getProcAddr(k32, "GetCommModemStatus")
+	nWaitCommEvent = getProcAddr(k32, "WaitCommEvent")
+	nClearCommError = getProcAddr(k32, "ClearCommError")
+	nSetCommBreak = getProcAddr(k32, "SetCommBreak")
+	nTransmitCommChar = getProcAddr(k32, "TransmitCommChar")
+	nClearCommBreak = getProcAddr(k32, "ClearCommBreak")
 	nFlushFileBuffers = getProcAddr(k32, "FlushFileBuffers")
 }
 
@@ -171,18 +782,60 @@ func getProcAddr(lib syscall.Handle, name string) uintptr {
 	return addr
 }
 
-func setCommState(h syscall.Handle, baud int, databits byte, parity Parity, stopbits StopBits) error {
-	var params structDCB
-	params.DCBlength = uint32(unsafe.Sizeof(params))
+// setCommState changes the fields of params that c covers, and applies
+// the result to h.
+func setCommState(h syscall.Handle, params *structDCB, c *Config) error {
+	params.DCBlength = uint32(unsafe.Sizeof(*params))
+
+	params.flags[0] |= 0x01  // fBinary
+	params.flags[0] &^= 0x06 // fParity, fOutxCtsFlow
+	params.flags[1] &^= 0x03 // fOutX, fInX
+	rtsControl := params.flags[1] & 0x30
+	params.flags[1] &^= 0x30
 
-	params.flags[0] = 0x01  // fBinary
-	params.flags[0] |= 0x10 // Assert DSR
+	if c.ReportErrors {
+		params.flags[0] |= 0x02 // fParity
+	}
 
-	params.BaudRate = uint32(baud)
+	if c.RTSFlowControl && c.RS485 != nil {
+		// RTS can't be used for both.
+		return ErrBadFlowControl
+	}
+	switch {
+	case c.RTSFlowControl:
+		params.flags[0] |= 0x04 // fOutxCtsFlow
+		rtsControl = 0x20       // RTS_CONTROL_HANDSHAKE
+	case c.RS485 != nil:
+		// The driver raises RTS while sending; the delays and
+		// polarity can't be configured.
+		rtsControl = 0x30 // RTS_CONTROL_TOGGLE
+	case rtsControl == 0x20 || rtsControl == 0x30:
+		// Back to SetRTS, starting with RTS lowered.
+		rtsControl = 0 // RTS_CONTROL_DISABLE
+	}
+	params.flags[1] |= rtsControl // fRtsControl
 
-	params.ByteSize = databits
+	if c.XONAny {
+		// The DCB has no equivalent of IXANY.
+		return ErrBadFlowControl
+	}
+	params.XonChar = c.XONChar
+	params.XoffChar = c.XOFFChar
+	if c.XONFlowControl {
+		if c.XONChar == c.XOFFChar {
+			return ErrBadFlowControl
+		}
+		params.flags[1] |= 0x01 // fOutX
+		params.flags[1] |= 0x02 // fInX
+		params.XonLim = 2048
+		params.XoffLim = 512
+	}
+
+	params.BaudRate = uint32(c.Baud)
 
-	switch parity {
+	params.ByteSize = c.Size
+
+	switch c.Parity {
 	case ParityNone:
 		params.Parity = 0
 	case ParityOdd:
@@ -197,7 +850,7 @@ func setCommState(h syscall.Handle, baud int, databits byte, parity Parity, stop
 		return ErrBadParity
 	}
 
-	switch stopbits {
+	switch c.StopBits {
 	case Stop1:
 		params.StopBits = 0
 	case Stop1Half:
@@ -208,28 +861,57 @@ func setCommState(h syscall.Handle, baud int, databits byte, parity Parity, stop
 		return ErrBadStopBits
 	}
 
-	r, _, err := syscall.Syscall(nSetCommState, 2, uintptr(h), uintptr(unsafe.Pointer(&params)), 0)
+	return setCommStateDCB(h, params)
+}
+
+func getCommState(h syscall.Handle, params *structDCB) error {
+	params.DCBlength = uint32(unsafe.Sizeof(*params))
+	r, _, err := syscall.Syscall(nGetCommState, 2, uintptr(h), uintptr(unsafe.Pointer(params)), 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func setCommStateDCB(h syscall.Handle, params *structDCB) error {
+	r, _, err := syscall.Syscall(nSetCommState, 2, uintptr(h), uintptr(unsafe.Pointer(params)), 0)
 	if r == 0 {
 		return err
 	}
 	return nil
 }
 
-func setCommTimeouts(h syscall.Handle, readTimeout time.Duration) error {
+func setCommTimeouts(h syscall.Handle, c *Config) error {
 	var timeouts structTimeouts
 	const MAXDWORD = 1<<32 - 1
 
+	// A write that times out completes with the bytes sent so far.
+	if c.WriteTimeout > 0 {
+		timeouts.WriteTotalTimeoutConstant = uint32(clampMs(c.WriteTimeout, MAXDWORD-1))
+	}
+
+	if c.InterCharTimeout > 0 {
+		// With only ReadIntervalTimeout and ReadTotalTimeoutConstant
+		// set, ReadFile waits for the first byte, then returns when
+		// the interval between two bytes is exceeded, the buffer is
+		// full, or the total timeout runs out.
+		timeouts.ReadIntervalTimeout = uint32(clampMs(c.InterCharTimeout, MAXDWORD-1))
+		if c.ReadTimeout > 0 {
+			timeouts.ReadTotalTimeoutConstant = uint32(clampMs(c.ReadTimeout, MAXDWORD-1))
+		}
+		r, _, err := syscall.Syscall(nSetCommTimeouts, 2, uintptr(h), uintptr(unsafe.Pointer(&timeouts)), 0)
+		if r == 0 {
+			return err
+		}
+		return nil
+	}
+
 	// blocking read by default
 	var timeoutMs int64 = MAXDWORD - 1
 
-	if readTimeout > 0 {
+	if c.ReadTimeout > 0 {
 		// non-blocking read
-		timeoutMs = readTimeout.Nanoseconds() / 1e6
-		if timeoutMs < 1 {
-			timeoutMs = 1
-		} else if timeoutMs > MAXDWORD-1 {
-			timeoutMs = MAXDWORD - 1
-		}
+		timeoutMs = clampMs(c.ReadTimeout, MAXDWORD-1)
 	}
 
 	/* From http://msdn.microsoft.com/en-us/library/aa363190(v=VS.85).aspx
@@ -265,6 +947,31 @@ func setCommTimeouts(h syscall.Handle, readTimeout time.Duration) error {
 	return nil
 }
 
+// clampMs returns d in milliseconds, between 1 and max.
+func clampMs(d time.Duration, max int64) int64 {
+	ms := d.Nanoseconds() / 1e6
+	if ms < 1 {
+		return 1
+	} else if ms > max {
+		return max
+	}
+	return ms
+}
+
+// disconnectedError reports the errors a port returns once its device
+// is gone as ErrDisconnected.
+func disconnectedError(err error) error {
+	const ERROR_BAD_COMMAND = 22
+	const ERROR_GEN_FAILURE = 31
+	const ERROR_DEVICE_NOT_CONNECTED = 1167
+	switch err {
+	case syscall.ERROR_ACCESS_DENIED, syscall.Errno(ERROR_BAD_COMMAND),
+		syscall.Errno(ERROR_GEN_FAILURE), syscall.Errno(ERROR_DEVICE_NOT_CONNECTED):
+		return ErrDisconnected
+	}
+	return err
+}
+
 func setupComm(h syscall.Handle, in, out int) error {
 	r, _, err := syscall.Syscall(nSetupComm, 3, uintptr(h), uintptr(in), uintptr(out))
 	if r == 0 {
@@ -273,15 +980,52 @@ func setupComm(h syscall.Handle, in, out int) error {
 	return nil
 }
 
+// Events reported by WaitCommEvent.
+const (
+	EV_CTS  = 0x0008
+	EV_DSR  = 0x0010
+	EV_RLSD = 0x0020
+	EV_RING = 0x0100
+
+	modemEvents = EV_CTS | EV_DSR | EV_RLSD | EV_RING
+)
+
 func setCommMask(h syscall.Handle) error {
-	const EV_RXCHAR = 0x0001
-	r, _, err := syscall.Syscall(nSetCommMask, 2, uintptr(h), EV_RXCHAR, 0)
+	r, _, err := syscall.Syscall(nSetCommMask, 2, uintptr(h), modemEvents, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func escapeCommFunction(h syscall.Handle, fn uintptr) error {
+	r, _, err := syscall.Syscall(nEscapeCommFunction, 2, uintptr(h), fn, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// transmitCommChar sends c ahead of any pending output.
+func transmitCommChar(h syscall.Handle, c byte) error {
+	r, _, err := syscall.Syscall(nTransmitCommChar, 2, uintptr(h), uintptr(c), 0)
 	if r == 0 {
 		return err
 	}
 	return nil
 }
 
+func clearCommError(h syscall.Handle) (uint32, *structComstat, error) {
+	var errs uint32
+	var stat structComstat
+	r, _, err := syscall.Syscall(nClearCommError, 3, uintptr(h),
+		uintptr(unsafe.Pointer(&errs)), uintptr(unsafe.Pointer(&stat)))
+	if r == 0 {
+		return 0, nil, err
+	}
+	return errs, &stat, nil
+}
+
 func resetEvent(h syscall.Handle) error {
 	r, _, err := syscall.Syscall(nResetEvent, 1, uintptr(h), 0, 0)
 	if r == 0 {
@@ -290,19 +1034,44 @@ func resetEvent(h syscall.Handle) error {
 	return nil
 }
 
-func purgeComm(h syscall.Handle) error {
-	const PURGE_TXABORT = 0x0001
-	const PURGE_RXABORT = 0x0002
-	const PURGE_TXCLEAR = 0x0004
-	const PURGE_RXCLEAR = 0x0008
-	r, _, err := syscall.Syscall(nPurgeComm, 2, uintptr(h),
-		PURGE_TXABORT|PURGE_RXABORT|PURGE_TXCLEAR|PURGE_RXCLEAR, 0)
+func purgeComm(h syscall.Handle, flags uintptr) error {
+	r, _, err := syscall.Syscall(nPurgeComm, 2, uintptr(h), flags, 0)
 	if r == 0 {
 		return err
 	}
 	return nil
 }
 
+func flushFileBuffers(h syscall.Handle) error {
+	r, _, err := syscall.Syscall(nFlushFileBuffers, 1, uintptr(h), 0, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func setEvent(h syscall.Handle) error {
+	r, _, err := syscall.Syscall(nSetEvent, 1, uintptr(h), 0, 0)
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// newEvent creates an event, which is auto-reset unless manualReset is
+// set.
+func newEvent(manualReset bool) (syscall.Handle, error) {
+	var manual uintptr
+	if manualReset {
+		manual = 1
+	}
+	r, _, err := syscall.Syscall6(nCreateEvent, 4, 0, manual, 0, 0, 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return syscall.Handle(r), nil
+}
+
 func newOverlapped() (*syscall.Overlapped, error) {
 	var overlapped syscall.Overlapped
 	r, _, err := syscall.Syscall6(nCreateEvent, 4, 0, 1, 0, 0, 0, 0)
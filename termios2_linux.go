@@ -0,0 +1,12 @@
+// +build linux,!ppc,!ppc64,!ppc64le
+
+package serial
+
+import "golang.org/x/sys/unix"
+
+// Requests for struct termios2, which carries the arbitrary baud rates
+// selected with BOTHER.
+const (
+	tcgets2 = unix.TCGETS2
+	tcsets2 = unix.TCSETS2
+)
@@ -0,0 +1,12 @@
+// +build linux,ppc linux,ppc64 linux,ppc64le
+
+package serial
+
+import "golang.org/x/sys/unix"
+
+// On powerpc the plain termios requests already carry the speed fields
+// used with BOTHER, and there is no separate termios2.
+const (
+	tcgets2 = unix.TCGETS
+	tcsets2 = unix.TCSETS
+)
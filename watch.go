@@ -0,0 +1,26 @@
+package serial
+
+// PortOp is the kind of change a PortEvent reports.
+type PortOp int
+
+const (
+	PortAdded PortOp = iota + 1
+	PortRemoved
+)
+
+func (op PortOp) String() string {
+	switch op {
+	case PortAdded:
+		return "added"
+	case PortRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// PortEvent is a serial port appearing or disappearing, as reported by
+// Watch.
+type PortEvent struct {
+	Op   PortOp
+	Port PortInfo
+}
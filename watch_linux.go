@@ -0,0 +1,177 @@
+// +build linux
+
+package serial
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Watch reports serial ports being added and removed, such as USB
+// adapters being plugged in and out, until ctx is done. The channel is
+// then closed. Ports present when Watch is called are not reported,
+// call ListPorts for those.
+//
+// Watch listens for the kernel's uevents on a netlink socket.
+func Watch(ctx context.Context) (<-chan PortEvent, error) {
+	src, err := newNetlinkSource()
+	if err != nil {
+		return nil, err
+	}
+	ch, err := watch(ctx, src, "/sys")
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	return ch, nil
+}
+
+// ueventSource delivers raw kernel uevents, one per read. Close makes a
+// pending read return.
+type ueventSource interface {
+	read() ([]byte, error)
+	Close() error
+}
+
+// watch reports the serial ports that the uevents from src add and
+// remove, looking them up in the sysfs tree at root. It closes src when
+// ctx is done.
+func watch(ctx context.Context, src ueventSource, root string) (<-chan PortEvent, error) {
+	ports, err := listPorts(root)
+	if err != nil {
+		return nil, err
+	}
+	// Removed ports are gone from sysfs, so remember what was there.
+	known := make(map[string]PortInfo)
+	for _, p := range ports {
+		known[p.Name] = p
+	}
+
+	ch := make(chan PortEvent)
+	stop := make(chan struct{})
+	var once sync.Once
+	closeSrc := func() { once.Do(func() { src.Close() }) }
+	go func() {
+		// Closing src interrupts a read in progress.
+		select {
+		case <-ctx.Done():
+			closeSrc()
+		case <-stop:
+		}
+	}()
+	go func() {
+		defer close(ch)
+		defer close(stop)
+		defer closeSrc()
+		for {
+			b, err := src.read()
+			if errors.Is(err, syscall.ENOBUFS) {
+				continue // the kernel dropped events
+			}
+			if err != nil {
+				return
+			}
+			ev, ok := portEvent(parseUevent(b), known, root)
+			if !ok {
+				continue
+			}
+			select {
+			case ch <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// uevent is a kernel uevent, with its environment.
+type uevent struct {
+	action string
+	env    map[string]string
+}
+
+// parseUevent parses a uevent message: a header of the form
+// action@devpath followed by KEY=value pairs, all NUL terminated. It
+// returns nil for other messages, such as those sent by udev.
+func parseUevent(b []byte) *uevent {
+	fields := bytes.Split(b, []byte{0})
+	if len(fields) == 0 || !bytes.Contains(fields[0], []byte("@")) {
+		return nil
+	}
+	ev := &uevent{env: make(map[string]string)}
+	for _, f := range fields[1:] {
+		if i := bytes.IndexByte(f, '='); i > 0 {
+			ev.env[string(f[:i])] = string(f[i+1:])
+		}
+	}
+	ev.action = ev.env["ACTION"]
+	return ev
+}
+
+// portEvent returns the PortEvent for ev, if it adds or removes a
+// serial port, and updates known to match.
+func portEvent(ev *uevent, known map[string]PortInfo, root string) (PortEvent, bool) {
+	if ev == nil || ev.env["SUBSYSTEM"] != "tty" || ev.env["DEVNAME"] == "" {
+		return PortEvent{}, false
+	}
+	base := filepath.Base(ev.env["DEVNAME"])
+	name := "/dev/" + base
+	switch ev.action {
+	case "add":
+		info, ok := portInfo(filepath.Join(root, "class", "tty", base))
+		if !ok {
+			return PortEvent{}, false
+		}
+		known[info.Name] = info
+		return PortEvent{Op: PortAdded, Port: info}, true
+	case "remove":
+		info, ok := known[name]
+		if !ok {
+			return PortEvent{}, false
+		}
+		delete(known, name)
+		return PortEvent{Op: PortRemoved, Port: info}, true
+	}
+	return PortEvent{}, false
+}
+
+// netlinkSource reads uevents from the kernel.
+type netlinkSource struct {
+	f   *os.File
+	buf []byte
+}
+
+func newNetlinkSource() (*netlinkSource, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, err
+	}
+	// Group 1 gets the kernel's events, not udev's.
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: 1}); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	// The descriptor is non-blocking, so os.File reads through the
+	// runtime poller and Close interrupts them.
+	return &netlinkSource{f: os.NewFile(uintptr(fd), "uevent"), buf: make([]byte, 64<<10)}, nil
+}
+
+func (s *netlinkSource) read() ([]byte, error) {
+	n, err := s.f.Read(s.buf)
+	if err != nil {
+		return nil, err
+	}
+	return s.buf[:n], nil
+}
+
+func (s *netlinkSource) Close() error {
+	return s.f.Close()
+}
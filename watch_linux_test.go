@@ -0,0 +1,156 @@
+// +build linux
+
+package serial
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// feedSource is a ueventSource that delivers the messages sent on it.
+type feedSource struct {
+	msgs   chan []byte
+	fail   chan struct{} // closed to make read fail
+	closed chan struct{}
+}
+
+func newFeedSource() *feedSource {
+	return &feedSource{msgs: make(chan []byte), fail: make(chan struct{}), closed: make(chan struct{})}
+}
+
+func (s *feedSource) read() ([]byte, error) {
+	select {
+	case b := <-s.msgs:
+		return b, nil
+	case <-s.fail:
+		return nil, errors.New("read failed")
+	case <-s.closed:
+		return nil, errors.New("closed")
+	}
+}
+
+func (s *feedSource) Close() error {
+	close(s.closed)
+	return nil
+}
+
+// ttyUevent returns a kernel uevent message for a tty.
+func ttyUevent(action, name string) []byte {
+	return []byte(action + "@/devices/x/tty/" + name + "\x00ACTION=" + action +
+		"\x00DEVPATH=/devices/x/tty/" + name + "\x00SUBSYSTEM=tty\x00DEVNAME=" + name + "\x00SEQNUM=1\x00")
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const pnp = "devices/pnp0/00:03"
+	const usb = "devices/pci0000:00/0000:00:14.0/usb1/1-2"
+	fakeSysfs(t, dir, map[string]string{
+		pnp + "/tty/ttyS0/type":        "4\n",
+		pnp + "/tty/ttyS0/device":      "->../../../00:03",
+		"class/tty/ttyS0":              "->../../" + pnp + "/tty/ttyS0",
+		"devices/virtual/tty/tty5/dev": "4:5\n",
+		"class/tty/tty5":               "->../../devices/virtual/tty/tty5",
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	src := newFeedSource()
+	ch, err := watch(ctx, src, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The adapter appears in sysfs before its uevent is sent.
+	fakeSysfs(t, dir, map[string]string{
+		usb + "/idVendor":                   "0403\n",
+		usb + "/idProduct":                  "6001\n",
+		usb + "/1-2:1.0/bInterfaceNumber":   "00\n",
+		usb + "/1-2:1.0/tty/ttyACM0/device": "->../../../1-2:1.0",
+		"class/tty/ttyACM0":                 "->../../" + usb + "/1-2:1.0/tty/ttyACM0",
+	})
+	go func() {
+		for _, msg := range [][]byte{
+			[]byte("libudev\x00\xfe\xed\xca\xfe"),
+			[]byte("add@/devices/pci0000:00/0000:00:14.0/usb1/1-2\x00ACTION=add\x00SUBSYSTEM=usb\x00DEVNAME=bus/usb/001/002\x00"),
+			ttyUevent("add", "tty5"),
+			ttyUevent("add", "ttyACM0"),
+			ttyUevent("remove", "ttyS1"),
+			ttyUevent("remove", "ttyACM0"),
+			ttyUevent("remove", "ttyS0"),
+		} {
+			select {
+			case src.msgs <- msg:
+			case <-src.closed:
+				return
+			}
+		}
+	}()
+
+	acm := PortInfo{Name: "/dev/ttyACM0", USB: true, VID: 0x0403, PID: 0x6001, Location: "1-2:1.0"}
+	want := []PortEvent{
+		{PortAdded, acm},
+		{PortRemoved, acm},
+		{PortRemoved, PortInfo{Name: "/dev/ttyS0"}},
+	}
+	for _, w := range want {
+		select {
+		case ev := <-ch:
+			if ev != w {
+				t.Errorf("got event %+v, want %+v", ev, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event, want %+v", w)
+		}
+	}
+
+	cancel()
+	select {
+	case ev, ok := <-ch:
+		if ok {
+			t.Errorf("got event %+v after cancel", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+}
+
+func TestWatchReadError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sysfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "class/tty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	src := newFeedSource()
+	ch, err := watch(context.Background(), src, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(src.fail)
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Error("got an event after the read failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after the read failed")
+	}
+	select {
+	case <-src.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("source not closed after the read failed")
+	}
+}
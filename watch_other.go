@@ -0,0 +1,11 @@
+// +build !linux
+
+package serial
+
+import "context"
+
+// Watch reports serial ports being added and removed. It is only
+// implemented on Linux, and returns ErrNotSupported elsewhere.
+func Watch(ctx context.Context) (<-chan PortEvent, error) {
+	return nil, ErrNotSupported
+}